@@ -20,152 +20,3348 @@
 // including out-of-bound indices and object keys that are not valid JSON
 // strings.
 //
+// To reference an object key containing a ".", escape it as "\.". A literal
+// "\" must likewise be escaped as "\\". Alternatively, an accessor may be
+// enclosed in double quotes, within which "." has no special meaning; for
+// example, "a.b".c references key c of key a.b. Within quotes, "\" still
+// escapes the following character, so a quote may be written as \". A key
+// that itself begins with a quote must be escaped as \".
+//
+// An array element may also be referenced by the value of one of its fields,
+// using a query accessor of the form "#(field=value)". For example,
+// "items.#(id=42).name" references the name of the first element of items
+// whose id is 42. value is compared to the field's JSON, ignoring
+// whitespace; if the field is a string, value may also be its unquoted
+// contents. Dots within a query do not separate accessors.
+//
 // As a special case, the length of the array (at application time) is a valid
 // array index. When this index is the last accessor in the path, the value
 // will be appended to the end of the array. If this special index is not the
 // last accessor, the path is considered malformed (and thus is ignored).
+// The special index "-" is equivalent to the length of the array, and so
+// always appends. Negative indices count from the end of the array, so -1
+// references the last element, overwriting it rather than appending. Unlike
+// the length index and "-", they may appear anywhere in the path.
+//
+// Offsets into json are ints, so on 32-bit platforms documents are limited
+// to roughly 2GB. A modification whose result would exceed this limit is
+// ignored, and the original json is returned.
 package mjson
 
-import (
-	"bytes"
-	gojson "encoding/json"
-	"reflect"
-	"strconv"
-	"strings"
-	"unsafe"
-)
+import (
+	"bytes"
+	"context"
+	gojson "encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Set replaces the value at path in json with obj. If path is malformed, the
+// original json is returned. If obj cannot be marshaled, Set panics.
+func Set(json []byte, path string, obj interface{}) []byte {
+	return rewritePath(json, path, marshal(obj), false)
+}
+
+// Options control how paths are resolved. A nil *Options is equivalent to
+// the zero value, which matches object keys exactly.
+type Options struct {
+	// CaseInsensitive matches object keys to accessors without regard to
+	// case, using Unicode case-folding.
+	CaseInsensitive bool
+	// NormalizeUnicode removes accents from both object keys and accessors
+	// before comparing them. Only combining diacritical marks and the
+	// accented letters of Latin-1 are recognized.
+	NormalizeUnicode bool
+	// TrimAccessors ignores leading and trailing whitespace in both object
+	// keys and accessors.
+	TrimAccessors bool
+	// CreatePath creates any objects and arrays along the path that do not
+	// exist yet, instead of treating the path as malformed. An index creates
+	// an array, and must be 0; any other accessor creates an object. An empty
+	// or whitespace-only document is treated as an empty object, or as an
+	// empty array if the first accessor is an index.
+	CreatePath bool
+	// MaxResultSize, if positive, is the maximum length of a modified
+	// document. If a modification would produce a larger document, it is
+	// ignored, and the original document is returned.
+	MaxResultSize int
+	// EscapeHTML escapes <, >, and & in marshaled strings, including strings
+	// within values that are passed to encoding/json.
+	EscapeHTML bool
+	// DedupeOnSet removes any later members of the object containing the
+	// value being set whose keys match the last accessor, so that only the
+	// modified member remains.
+	DedupeOnSet bool
+	// MaxScan, if positive, is the maximum length of any single value that
+	// may be skipped while resolving a path. If a sibling of a value along
+	// the path is longer, the path is treated as malformed, bounding the
+	// work done on adversarial documents.
+	MaxScan int
+	// RejectDuplicateKeys causes ValidateOpts to reject any object that
+	// contains the same key more than once. Keys are compared after decoding
+	// their escape sequences.
+	RejectDuplicateKeys bool
+
+	// walk, if non-nil, is called with each accessor as it is resolved.
+	walk func(acc string, found bool)
+}
+
+// tooLarge reports whether a document of length n exceeds
+// opts.MaxResultSize.
+func (opts *Options) tooLarge(n int) bool {
+	return opts != nil && opts.MaxResultSize > 0 && n > opts.MaxResultSize
+}
+
+// skipValue is consumeValue, but if opts.MaxScan is positive and the value
+// at the start of json is longer than opts.MaxScan, skipValue returns nil
+// without scanning further than the limit.
+func (opts *Options) skipValue(json []byte) []byte {
+	if opts == nil || opts.MaxScan <= 0 || len(json) <= opts.MaxScan {
+		return consumeValue(json)
+	}
+	// scan one byte past the limit, so that a value ending within the limit
+	// leaves at least one byte unconsumed; but always scan enough bytes to
+	// consume any literal
+	lim := max(opts.MaxScan+1, len("false")+1)
+	if lim >= len(json) {
+		return consumeValue(json)
+	}
+	rest := consumeValue(json[:lim])
+	if rest == nil || len(rest) == lim || lim-len(rest) > opts.MaxScan {
+		return nil
+	}
+	return json[lim-len(rest):]
+}
+
+// skipElements skips each element of the array at the start of json with
+// skipValue, returning the number of elements and the remainder of json,
+// starting at the closing ]. If the array is unterminated, or an element
+// cannot be skipped, skipElements returns a nil remainder.
+func (opts *Options) skipElements(json []byte) (int, []byte) {
+	json = consumeSeparator(json) // consume [
+	var n int
+	for len(json) > 0 && json[0] != ']' {
+		if json = opts.skipValue(json); json == nil {
+			return 0, nil
+		}
+		n++
+		json = consumeWhitespace(json)
+		if len(json) > 0 && json[0] == ',' {
+			json = consumeSeparator(json) // consume ,
+		}
+	}
+	if len(json) == 0 {
+		return 0, nil
+	}
+	return n, json
+}
+
+// keyMatches reports whether the object key key, which is still escaped,
+// matches acc under opts.
+func (opts *Options) keyMatches(key []byte, acc string) bool {
+	k := unescapeString(key)
+	if opts.NormalizeUnicode {
+		k, acc = removeAccents(k), removeAccents(acc)
+	}
+	if opts.TrimAccessors {
+		k = strings.TrimSpace(k)
+	}
+	if opts.CaseInsensitive {
+		return strings.EqualFold(k, acc)
+	}
+	return k == acc
+}
+
+// latin1Accents maps the Latin-1 letters U+00C0 through U+00FF to their
+// unaccented equivalents. Letters without an equivalent map to 0.
+const latin1Accents = "AAAAAA\x00CEEEEIIII\x00NOOOOO\x00OUUUUY\x00\x00" +
+	"aaaaaa\x00ceeeeiiii\x00nooooo\x00ouuuuy\x00y"
+
+// removeAccents returns s with combining diacritical marks removed and
+// accented Latin-1 letters replaced by their unaccented equivalents.
+func removeAccents(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 0x300 <= r && r <= 0x36F {
+			return -1 // combining mark
+		} else if 0xC0 <= r && r <= 0xFF && latin1Accents[r-0xC0] != 0 {
+			return rune(latin1Accents[r-0xC0])
+		}
+		return r
+	}, s)
+}
+
+// SetOpts replaces the value at path in json with obj, resolving path
+// according to opts. If opts is nil, SetOpts is equivalent to Set. If path is
+// malformed, the original json is returned. If obj cannot be marshaled,
+// SetOpts panics.
+func SetOpts(json []byte, path string, obj interface{}, opts *Options) []byte {
+	return rewritePathMode(json, path, marshalOpts(obj, opts), modeCopy, opts)
+}
+
+// UpsertReport is like SetOpts with the CreatePath option, but also returns
+// the accessors of path that did not exist in json and had to be created, in
+// order. If the value at path already existed, or if path is malformed, no
+// accessors are reported. If obj cannot be marshaled, UpsertReport panics.
+func UpsertReport(json []byte, path string, obj interface{}) (result []byte, createdSegments []string) {
+	opts := &Options{CreatePath: true}
+	result = SetOpts(json, path, obj, opts)
+	if path == "" {
+		return result, nil
+	} else if len(consumeWhitespace(json)) == 0 {
+		createdSegments = accessors(path)
+	} else if i, lastAcc, rest := locatePath(json, path, opts); i != -1 && (json[i] == '}' || json[i] == ']' || json[i] == 'l') {
+		createdSegments = append([]string{lastAcc}, accessors(rest)...)
+	}
+	if bytes.Equal(result, json) {
+		// nothing could be created
+		return result, nil
+	}
+	return result, createdSegments
+}
+
+// Override sets each path in overrides to its corresponding value, creating
+// any missing objects and arrays along the way, as with the CreatePath
+// option. Paths are applied in sorted order, so a path is always applied
+// before any paths it is a prefix of. A nil value sets the key to null; it
+// does not delete it. Overrides whose paths are malformed are skipped. If a
+// value cannot be marshaled, Override panics.
+func Override(base []byte, overrides map[string]interface{}) []byte {
+	paths := make([]string, 0, len(overrides))
+	for path := range overrides {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	opts := &Options{CreatePath: true}
+	for _, path := range paths {
+		base = SetOpts(base, path, overrides[path], opts)
+	}
+	return base
+}
+
+// SetWithWalkHook is like Set, but calls hook with each accessor in path as
+// it is resolved, reporting whether the accessor referenced an existing
+// value. found is false for the last accessor if it references a new object
+// key or the end of an array. If an accessor cannot be resolved, hook is
+// called with found set to false, and is not called for any subsequent
+// accessors.
+func SetWithWalkHook(json []byte, path string, obj interface{}, hook func(accessor string, found bool)) []byte {
+	return rewritePathMode(json, path, marshal(obj), modeCopy, &Options{walk: hook})
+}
+
+// SetFloatFmt replaces the value at path in json with val, formatted as by
+// strconv.FormatFloat with the given format and precision. Only the 'e', 'E',
+// 'f', 'g', and 'G' formats are supported, since the others do not produce
+// valid JSON. If path is malformed, format is unsupported, or val is NaN or
+// infinite, the original json is returned.
+func SetFloatFmt(json []byte, path string, val float64, format byte, prec int) []byte {
+	switch format {
+	case 'e', 'E', 'f', 'g', 'G':
+	default:
+		return json
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return json
+	}
+	return rewritePath(json, path, strconv.AppendFloat(nil, val, format, prec, 64), false)
+}
+
+// SetNumberAsString replaces the value at path in json with val as a string,
+// e.g. "123.45", as some APIs do to preserve precision. val must be a valid
+// JSON number. If path is malformed or val is not a valid number, the
+// original json is returned.
+func SetNumberAsString(json []byte, path string, val string) []byte {
+	if val == "" {
+		return json
+	} else if n, err := validateNumber([]byte(val), 0); err != nil || n != len(val) {
+		return json
+	}
+	return rewritePath(json, path, append(append([]byte{'"'}, val...), '"'), false)
+}
+
+// SetFirst replaces the value at the first of paths that already exists in
+// json with obj, trying each in order. Paths that would insert a new value
+// are skipped. If no path exists, the original json is returned. If obj
+// cannot be marshaled, SetFirst panics.
+func SetFirst(json []byte, paths []string, obj interface{}) []byte {
+	for _, path := range paths {
+		if locateValue(json, path) != -1 {
+			return Set(json, path, obj)
+		}
+	}
+	return json
+}
+
+// SoftDelete replaces the value at path in json with null, leaving the member
+// or element in place. Unlike Set, SoftDelete never inserts a value: if path
+// is malformed or does not reference an existing value, the original json is
+// returned.
+func SoftDelete(json []byte, path string) []byte {
+	return SoftDeleteWith(json, path, []byte("null"))
+}
+
+// SoftDeleteWith is like SoftDelete, but replaces the value with tombstone,
+// which must be valid JSON, e.g. {"__deleted":true}.
+func SoftDeleteWith(json []byte, path string, tombstone []byte) []byte {
+	if locateValue(json, path) == -1 {
+		return json
+	}
+	return rewritePath(json, path, tombstone, false)
+}
+
+// SetSparse is like Set, but if path references an index n beyond the end of
+// an array of length m, positions m through n-1 are filled with null and obj
+// is placed at index n. If path is malformed, or the gap would require more
+// than 64 MiB of padding, the original json is returned. If obj cannot be
+// marshaled, SetSparse panics.
+func SetSparse(json []byte, path string, obj interface{}) []byte {
+	start, isArray, ok := Parent(json, path)
+	n, err := strconv.Atoi(lastAccessor(path))
+	if !ok || !isArray || err != nil {
+		return Set(json, path, obj)
+	} else if consumeValue(json[start:]) == nil {
+		return json
+	}
+	var m int
+	forEachElement(json[start:], func(_, _ int) bool {
+		m++
+		return true
+	})
+	if n <= m {
+		return Set(json, path, obj)
+	}
+	// refuse gaps whose padding would overflow or exceed maxSparsePadding,
+	// rather than allocating an arbitrarily large document
+	if n-m > maxSparsePadding/len("null,") || addLen(len(json), (n-m)*len("null,")) == -1 {
+		return json
+	}
+	val := bytes.Repeat([]byte("null,"), n-m)
+	val = append(val, marshal(obj)...)
+	end := start + len(json[start:]) - len(consumeValue(json[start:])) - 1 // offset of ]
+	return rewriteAt(json, end, "", val, modeCopy, nil)
+}
+
+// maxSparsePadding is the maximum number of bytes of null padding that
+// SetSparse will insert.
+const maxSparsePadding = 1 << 26
+
+// CopyFrom replaces the value at dstPath in dst with the value at srcPath in
+// src. If either path is malformed, the original dst is returned.
+func CopyFrom(dst []byte, dstPath string, src []byte, srcPath string) []byte {
+	val := Get(src, srcPath)
+	if val == nil {
+		return dst
+	}
+	return rewritePath(dst, dstPath, val, false)
+}
+
+// SetFloatExact replaces the value at path in json with val, formatted as Set
+// would format it. If forceDecimal is true and val is integral, a ".0" suffix
+// is added (e.g. 5.0 rather than 5), so that the value is unambiguously a
+// float. If path is malformed, or val is NaN or infinite, the original json is
+// returned.
+func SetFloatExact(json []byte, path string, val float64, forceDecimal bool) []byte {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return json
+	}
+	b := marshal(val)
+	if forceDecimal && bytes.IndexAny(b, ".eE") == -1 {
+		b = append(b, ".0"...)
+	}
+	return rewritePath(json, path, b, false)
+}
+
+// SetSafe is like Set, but if obj cannot be marshaled, it returns the original
+// json and an error rather than panicking. NaN and infinite floats are also
+// reported as errors.
+func SetSafe(json []byte, path string, obj interface{}) (result []byte, err error) {
+	val, err := safeMarshal(obj)
+	if err != nil {
+		return json, err
+	}
+	return rewritePath(json, path, val, false), nil
+}
+
+// safeMarshal is marshal, but returns an error instead of panicking. Unlike
+// marshal, it also rejects NaN and infinite floats, which have no JSON
+// representation.
+func safeMarshal(obj interface{}) (b []byte, err error) {
+	var f float64
+	switch v := obj.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("mjson: could not marshal value: unsupported value %v", f)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = fmt.Errorf("mjson: could not marshal value: %w", e)
+			} else {
+				err = fmt.Errorf("mjson: could not marshal value: %v", r)
+			}
+		}
+	}()
+	return marshal(obj), nil
+}
+
+// SetQuiet is like Set, but if the value at path is already equal to obj,
+// ignoring whitespace, it returns the original json rather than a copy. If
+// obj cannot be marshaled, SetQuiet panics.
+func SetQuiet(json []byte, path string, obj interface{}) []byte {
+	val := marshal(obj)
+	if path == "" {
+		if old := Get(json, path); old != nil && bytes.Equal(appendCompact(nil, old), appendCompact(nil, val)) {
+			return json
+		}
+		return rewritePath(json, path, val, false)
+	}
+	i, lastAcc, _ := locatePath(json, path, nil)
+	if i == -1 {
+		return json
+	} else if c := json[i]; c != '}' && c != ']' && c != 'l' {
+		old := json[i : len(json)-len(consumeValue(json[i:]))]
+		if bytes.Equal(appendCompact(nil, old), appendCompact(nil, val)) {
+			return json
+		}
+	}
+	return rewriteAt(json, i, lastAcc, val, modeCopy, nil)
+}
+
+// SetKeyChecked is like Set, but if a new object key is inserted, the object
+// containing it is validated afterward. If the object is no longer valid,
+// the original json is returned, along with an error. Unlike Set, a malformed
+// path is also reported as an error. If obj cannot be marshaled,
+// SetKeyChecked panics.
+func SetKeyChecked(json []byte, path string, obj interface{}) ([]byte, error) {
+	if path == "" {
+		return Set(json, path, obj), nil
+	}
+	i, lastAcc, _ := locatePath(json, path, nil)
+	if i == -1 {
+		return json, fmt.Errorf("mjson: malformed path %q", path)
+	}
+	newJSON := rewriteAt(json, i, lastAcc, marshal(obj), modeCopy, nil)
+	if json[i] == '}' {
+		start, _, _ := Parent(json, path)
+		if _, err := validateObject(newJSON, start, nil); err != nil {
+			return json, fmt.Errorf("mjson: inserting key %q produced invalid JSON: %w", lastAcc, err)
+		}
+	}
+	return newJSON, nil
+}
+
+// SetValidated is like Set, but validates the resulting document as if by
+// Validate. If the result is not valid JSON -- e.g. because json was already
+// invalid, or because obj's MarshalJSON method returned invalid JSON -- the
+// original json is returned, along with the validation error. If path is
+// malformed, the original json is returned without error, as with Set. If obj
+// cannot be marshaled, SetValidated panics.
+func SetValidated(json []byte, path string, obj interface{}) ([]byte, error) {
+	newJSON := Set(json, path, obj)
+	if err := Validate(newJSON); err != nil {
+		return json, err
+	}
+	return newJSON, nil
+}
+
+// SetWithExpiry replaces the value at path in json with an object of the form
+// {"value":value,"expires":expires}, where expires is formatted as an RFC
+// 3339 timestamp. If path is malformed, the original json is returned. If
+// value cannot be marshaled, SetWithExpiry panics.
+func SetWithExpiry(json []byte, path string, value interface{}, expires time.Time) []byte {
+	val := append([]byte(`{"value":`), marshal(value)...)
+	val = append(val, `,"expires":"`...)
+	val = expires.AppendFormat(val, time.RFC3339)
+	val = append(val, `"}`...)
+	return rewritePath(json, path, val, false)
+}
+
+// SetWithHistory replaces the value at path in json with obj, first appending
+// the old value to the array at historyField in the same object. If
+// historyField does not exist, it is created. If path does not exist yet,
+// there is no old value, and SetWithHistory is equivalent to Set. If path is
+// malformed, its parent is not an object, or historyField is neither an
+// array nor null, the original json is returned. If obj cannot be marshaled,
+// SetWithHistory panics.
+func SetWithHistory(json []byte, path, historyField string, obj interface{}) []byte {
+	if _, isArray, ok := Parent(json, path); !ok || isArray {
+		return json
+	}
+	old := Get(json, path)
+	if old == nil {
+		return Set(json, path, obj)
+	}
+	histPath := escapeAccessor(historyField)
+	if parent := parentPath(path); parent != "" {
+		histPath = parent + "." + histPath
+	}
+	var newJSON []byte
+	switch Type(json, histPath) {
+	case Array, Null:
+		newJSON = rewritePath(json, histPath+".-", old, false)
+	case Invalid:
+		newJSON = rewritePath(json, histPath, append(append([]byte{'['}, old...), ']'), false)
+	default:
+		return json
+	}
+	return Set(newJSON, path, obj)
+}
+
+// SetTypedStrict is like Set, but returns an error if the value at path is
+// not of Kind expect, rather than replacing it. If path does not exist yet
+// (i.e. it references a new object key or the end of an array), there is no
+// existing value to check, and the value is set regardless of expect. Unlike
+// Set, a malformed path is also reported as an error. If obj cannot be
+// marshaled, SetTypedStrict panics.
+func SetTypedStrict(json []byte, path string, obj interface{}, expect Kind) ([]byte, error) {
+	if path != "" {
+		if i, _, _ := locatePath(json, path, nil); i == -1 {
+			return json, fmt.Errorf("mjson: malformed path %q", path)
+		}
+	}
+	if k := Type(json, path); k != Invalid && k != expect {
+		return json, fmt.Errorf("mjson: value at path %q is %v, not %v", path, k, expect)
+	}
+	return Set(json, path, obj), nil
+}
+
+// SetComputed replaces the value at path in json with the result of calling
+// fn on json. fn sees the document as it was before the modification. If path
+// is malformed, the original json is returned. If the result of fn cannot be
+// marshaled, SetComputed panics.
+func SetComputed(json []byte, path string, fn func(doc []byte) interface{}) []byte {
+	return Set(json, path, fn(json))
+}
+
+// SetInPlace replaces the value at path in json with obj. If the length of
+// obj is less than the existing value at that path, or if json has enough
+// spare capacity to hold the result, json will be modified in place. The
+// result may contain extra whitespace. If path is malformed, the
+// original json is returned. If obj cannot be marshaled, SetInPlace panics.
+func SetInPlace(json []byte, path string, obj interface{}) []byte {
+	return rewritePath(json, path, marshal(obj), true)
+}
+
+// SetRawCompact replaces the value at path in json with val, after removing
+// all whitespace outside of strings from val. val itself is not modified. If
+// path is malformed, the original json is returned.
+func SetRawCompact(json []byte, path string, val []byte) []byte {
+	return rewritePath(json, path, appendCompact(make([]byte, 0, len(val)), val), false)
+}
+
+// SetRawInPlace replaces the value at path in json with val. If the length of
+// val is less than the existing value at that path, or if json has enough
+// spare capacity to hold the result, json will be modified in place. The
+// result may contain extra whitespace. If path is malformed, the
+// original json is returned. If val cannot be marshaled, SetRawInPlace
+// panics.
+func SetRawInPlace(json []byte, path string, val []byte) []byte {
+	return rewritePath(json, path, val, true)
+}
+
+// SetRawInPlaceShrink replaces the value at path in json with val, modifying
+// json in place where possible. Unlike SetRawInPlace, if val is shorter than
+// the existing value, the rest of json is shifted left rather than padded
+// with whitespace, so the result may be shorter than json. If path is
+// malformed, the original json is returned.
+func SetRawInPlaceShrink(json []byte, path string, val []byte) []byte {
+	return rewritePathMode(json, path, val, modeShift, nil)
+}
+
+// Get returns the value at path in json. If the value is an object or array,
+// the returned slice spans its opening and closing delimiters, and any
+// whitespace between them is preserved verbatim. The returned slice aliases
+// json; use Extract to obtain an independent copy. If path is malformed, Get
+// returns nil.
+func Get(json []byte, path string) []byte {
+	i := locateValue(json, path)
+	if i == -1 {
+		return nil
+	}
+	rest := consumeValue(json[i:])
+	if rest == nil {
+		return nil
+	}
+	return json[i : len(json)-len(rest)]
+}
+
+// GetOpts is like Get, but resolves path according to opts. Options that
+// only affect modifications, such as CreatePath, are ignored. If opts is nil,
+// GetOpts is equivalent to Get.
+func GetOpts(json []byte, path string, opts *Options) []byte {
+	if opts == nil || path == "" {
+		return Get(json, path)
+	}
+	i, _, _ := locatePath(json, path, &Options{
+		CaseInsensitive:  opts.CaseInsensitive,
+		NormalizeUnicode: opts.NormalizeUnicode,
+		TrimAccessors:    opts.TrimAccessors,
+		MaxScan:          opts.MaxScan,
+	})
+	if i == -1 || json[i] == '}' || json[i] == ']' || json[i] == 'l' {
+		return nil
+	}
+	rest := consumeValue(json[i:])
+	if rest == nil {
+		return nil
+	}
+	return json[i : len(json)-len(rest)]
+}
+
+// ValueSize returns the length in bytes of the value at path in json, as it
+// appears in json. If path is malformed, ValueSize returns -1.
+func ValueSize(json []byte, path string) int {
+	i := locateValue(json, path)
+	if i == -1 {
+		return -1
+	}
+	rest := consumeValue(json[i:])
+	if rest == nil {
+		return -1
+	}
+	return len(json[i:]) - len(rest)
+}
+
+// Extract returns a copy of the value at path in json. Unlike the slice
+// returned by Get, it does not share memory with json, so either may be
+// modified without affecting the other. If path is malformed, Extract
+// returns nil.
+func Extract(json []byte, path string) []byte {
+	if val := Get(json, path); val != nil {
+		return append([]byte{}, val...)
+	}
+	return nil
+}
+
+// GetInto appends the value at path in json to dst and returns the extended
+// slice. Like Extract, the result does not share memory with json; unlike
+// Extract, dst may be reused across calls to avoid allocating. If path is
+// malformed, GetInto returns dst unmodified and false.
+func GetInto(dst []byte, json []byte, path string) ([]byte, bool) {
+	val := Get(json, path)
+	if val == nil {
+		return dst, false
+	}
+	return append(dst, val...), true
+}
+
+// CompactClone returns a copy of json with all whitespace outside of strings
+// removed. The contents of strings are copied verbatim.
+func CompactClone(json []byte) []byte {
+	return appendCompact(make([]byte, 0, len(json)), json)
+}
+
+// SameValue reports whether the values at paths a and b in json are equal,
+// ignoring whitespace outside of strings. If either path is malformed,
+// SameValue returns false.
+func SameValue(json []byte, a, b string) bool {
+	va, vb := Get(json, a), Get(json, b)
+	return va != nil && vb != nil && bytes.Equal(appendCompact(nil, va), appendCompact(nil, vb))
+}
+
+// EqualValue reports whether json and value are equivalent JSON values,
+// ignoring whitespace and the order of object keys. Strings, including keys,
+// are compared after decoding their escape sequences; numbers must be spelled
+// identically. If either is empty or unterminated, EqualValue returns false.
+func EqualValue(json []byte, value []byte) bool {
+	i, j := locateValue(json, ""), locateValue(value, "")
+	if i == -1 || j == -1 || consumeValue(json[i:]) == nil || consumeValue(value[j:]) == nil {
+		return false
+	}
+	return valuesEqual(json[i:], value[j:])
+}
+
+// valuesEqual reports whether the values at the start of a and b are
+// equivalent, as defined by EqualValue. Both must be terminated.
+func valuesEqual(a, b []byte) bool {
+	if a[0] != b[0] {
+		return false
+	}
+	switch a[0] {
+	case '{':
+		am, bm := objectMembers(a), objectMembers(b)
+		if len(am) != len(bm) {
+			return false
+		}
+		for k, av := range am {
+			if bv, ok := bm[k]; !ok || !valuesEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	case '[':
+		ae, be := arrayElements(a), arrayElements(b)
+		if len(ae) != len(be) {
+			return false
+		}
+		for k := range ae {
+			if !valuesEqual(ae[k], be[k]) {
+				return false
+			}
+		}
+		return true
+	case '"':
+		as, bs := a[:len(a)-len(consumeString(a))], b[:len(b)-len(consumeString(b))]
+		return unescapeString(as[1:len(as)-1]) == unescapeString(bs[1:len(bs)-1])
+	default:
+		return bytes.Equal(a[:len(a)-len(consumeValue(a))], b[:len(b)-len(consumeValue(b))])
+	}
+}
+
+// objectMembers returns the members of the object at the start of json,
+// keyed by their decoded keys. If a key appears more than once, the last
+// value wins.
+func objectMembers(json []byte) map[string][]byte {
+	m := make(map[string][]byte)
+	for _, mem := range Members(json, "") {
+		m[mem.Key] = mem.Value
+	}
+	return m
+}
+
+// CompactPath removes all whitespace outside of strings from the value at
+// path in json, leaving the rest of json untouched. Since the value can only
+// shrink, json is modified in place, as with SetRawInPlaceShrink. If path is
+// malformed, the original json is returned.
+func CompactPath(json []byte, path string) []byte {
+	i := locateValue(json, path)
+	if i == -1 {
+		return json
+	}
+	return rewriteAt(json, i, "", appendCompact(nil, Get(json, path)), modeShift, nil)
+}
+
+// GetRaw returns a copy of the value at path in json as a json.RawMessage,
+// suitable for further decoding with encoding/json. If path is malformed,
+// GetRaw returns nil.
+func GetRaw(json []byte, path string) gojson.RawMessage {
+	return Extract(json, path)
+}
+
+// ShrinkToFit returns a copy of json whose capacity is equal to its length,
+// allowing any excess capacity of json to be reclaimed. This is useful for
+// documents produced by the in-place functions, whose results may retain the
+// capacity of a larger buffer.
+func ShrinkToFit(json []byte) []byte {
+	return append(make([]byte, 0, len(json)), json...)
+}
+
+// GetOr returns the value at path in json. If path is malformed, GetOr
+// returns def.
+func GetOr(json []byte, path string, def []byte) []byte {
+	if val := Get(json, path); val != nil {
+		return val
+	}
+	return def
+}
+
+// GetResolved is like Get, but if the value at path is a reference -- an
+// object whose only member is "$ref", with a string value -- GetResolved
+// follows the reference, interpreting the string as a path within json, and
+// returns the referenced value. Chains of references are followed to their
+// end. If a reference target is missing, or the chain contains a cycle,
+// GetResolved returns nil.
+func GetResolved(json []byte, path string) []byte {
+	seen := make(map[string]bool)
+	for {
+		val := Get(json, path)
+		if val == nil || val[0] != '{' {
+			return val
+		}
+		members := Members(val, "")
+		if len(members) != 1 || members[0].Key != "$ref" || members[0].Value[0] != '"' {
+			return val
+		}
+		seen[path] = true
+		ref := members[0].Value
+		if path = unescapeString(ref[1 : len(ref)-1]); seen[path] {
+			return nil // cycle
+		}
+	}
+}
+
+// GetFirst returns the value at the first of paths that is not malformed in
+// json, trying each in order. If every path is malformed, GetFirst returns
+// nil.
+func GetFirst(json []byte, paths ...string) []byte {
+	for _, path := range paths {
+		if val := Get(json, path); val != nil {
+			return val
+		}
+	}
+	return nil
+}
+
+// Parent returns the offset of the object or array in json that contains the
+// value at path, and whether that container is an array. The last accessor
+// in path is not resolved, so it need not exist. If path is empty, or if the
+// parent is malformed or is not an object or array, ok is false.
+func Parent(json []byte, path string) (containerStart int, isArray bool, ok bool) {
+	if path == "" {
+		return 0, false, false
+	}
+	i := len(json) - len(consumeWhitespace(json))
+	for {
+		acc, rest, last := nextAccessor(path)
+		if last {
+			break
+		} else if i = seekAccessor(json, i, acc, false, nil); i == -1 {
+			return 0, false, false
+		}
+		path = rest
+	}
+	if i < len(json) {
+		switch json[i] {
+		case '{':
+			return i, false, true
+		case '[':
+			return i, true, true
+		}
+	}
+	return 0, false, false
+}
+
+// A Member is a single member of a JSON object.
+type Member struct {
+	Key   string // with escape sequences decoded
+	Value []byte
+}
+
+// Members returns the members of the object at path in json, in the order
+// they appear. If path is malformed or does not reference an object, Members
+// returns nil.
+func Members(json []byte, path string) []Member {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '{' || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	members := []Member{}
+	forEachMember(json[i:], func(keyStart, valStart, valEnd int) bool {
+		key, _ := parseString(json[i+keyStart:])
+		members = append(members, Member{unescapeString(key), json[i+valStart : i+valEnd]})
+		return true
+	})
+	return members
+}
+
+// Entries returns the members of the object at path in json as an array of
+// {"key":K,"value":V} objects, in the order they appear. Keys and values are
+// copied verbatim. If path is malformed or does not reference an object,
+// Entries returns nil.
+func Entries(json []byte, path string) []byte {
+	return entries(json, path, false)
+}
+
+// EntryPairs is like Entries, but represents each member as a [K,V] array.
+func EntryPairs(json []byte, path string) []byte {
+	return entries(json, path, true)
+}
+
+// FromEntries is the inverse of Entries and EntryPairs: it converts the array
+// at path in json, whose elements are [K,V] arrays or {"key":K,"value":V}
+// objects, into an object, preserving the order of the entries. Each K must
+// be a string. If a key appears more than once, the last value wins, but the
+// key retains the position of its first appearance. If path is malformed, or
+// does not reference an array of entries, FromEntries returns nil.
+func FromEntries(json []byte, path string) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	var keys []string
+	vals := make(map[string][]byte)
+	ok := true
+	forEachElement(json[i:], func(start, end int) bool {
+		var k, v []byte
+		switch elem := json[i+start : i+end]; elem[0] {
+		case '[':
+			if e := arrayElements(elem); len(e) == 2 {
+				k, v = e[0], e[1]
+			}
+		case '{':
+			k, v = Get(elem, "key"), Get(elem, "value")
+		}
+		if ok = k != nil && v != nil && k[0] == '"'; !ok {
+			return false
+		}
+		key := unescapeString(k[1 : len(k)-1])
+		if _, dup := vals[key]; !dup {
+			keys = append(keys, key)
+		}
+		vals[key] = v
+		return true
+	})
+	if !ok {
+		return nil
+	}
+	buf := []byte{'{'}
+	for j, key := range keys {
+		if j > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendEscapedString(buf, key, false)
+		buf = append(buf, ':')
+		buf = append(buf, vals[key]...)
+	}
+	return append(buf, '}')
+}
+
+func entries(json []byte, path string, pairs bool) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '{' || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	buf := []byte{'['}
+	forEachMember(json[i:], func(keyStart, valStart, valEnd int) bool {
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		key := json[i+keyStart : len(json)-len(consumeString(json[i+keyStart:]))]
+		val := json[i+valStart : i+valEnd]
+		if pairs {
+			buf = append(append(append(append(append(buf, '['), key...), ','), val...), ']')
+		} else {
+			buf = append(append(append(append(append(buf, `{"key":`...), key...), `,"value":`...), val...), '}')
+		}
+		return true
+	})
+	return append(buf, ']')
+}
+
+// LocateMember returns the span of the object member at path in json, from
+// the opening quote of its key through the end of its value. If path is
+// malformed or references an array element, ok is false.
+func LocateMember(json []byte, path string) (keyStart, valueEnd int, ok bool) {
+	start, isArray, ok := Parent(json, path)
+	if !ok || isArray || consumeValue(json[start:]) == nil {
+		return 0, 0, false
+	}
+	key := lastAccessor(path)
+	ok = false
+	forEachMember(json[start:], func(ks, _, ve int) bool {
+		if k, _ := parseString(json[start+ks:]); keyEquals(k, key) {
+			keyStart, valueEnd, ok = start+ks, start+ve, true
+		}
+		return !ok
+	})
+	return keyStart, valueEnd, ok
+}
+
+// IndexOffset returns the offset in json at which element index of the array
+// at path begins. If index is the length of the array, IndexOffset returns
+// the offset of the closing ], where a new element would be appended. If path
+// is malformed or does not reference an array, or if index is negative or
+// greater than the length of the array, IndexOffset returns -1.
+func IndexOffset(json []byte, path string, index int) int {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' || index < 0 || consumeValue(json[i:]) == nil {
+		return -1
+	}
+	off := locateAccessor(json[i:], strconv.Itoa(index), nil)
+	if off == -1 {
+		return -1
+	}
+	return i + off
+}
+
+// GetIndices returns the elements of the array at path in json at each of
+// the supplied indices, in the order requested, scanning the array only once.
+// Each out-of-range index yields nil. If path is malformed or does not
+// reference an array, or if the array ends before the largest index and is
+// unterminated, every element of the result is nil.
+func GetIndices(json []byte, path string, indices ...int) [][]byte {
+	vals := make([][]byte, len(indices))
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' {
+		return vals
+	}
+	max := -1
+	for _, index := range indices {
+		if index > max {
+			max = index
+		}
+	}
+	var n int
+	forEachElement(json[i:], func(start, end int) bool {
+		for j, index := range indices {
+			if index == n {
+				vals[j] = json[i+start : i+end]
+			}
+		}
+		n++
+		return n <= max
+	})
+	if n <= max && consumeValue(json[i:]) == nil {
+		// reached the end of the array, which is unterminated
+		return make([][]byte, len(indices))
+	}
+	return vals
+}
+
+// Head returns the first n elements of the array at path in json, scanning
+// no further than necessary. If the array has fewer than n elements, all of
+// them are returned. If path is malformed or does not reference an array, or
+// if the array has fewer than n elements and is unterminated, Head returns
+// nil.
+func Head(json []byte, path string, n int) [][]byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' {
+		return nil
+	}
+	vals := [][]byte{}
+	if n <= 0 {
+		return vals
+	}
+	forEachElement(json[i:], func(start, end int) bool {
+		vals = append(vals, json[i+start:i+end])
+		return len(vals) < n
+	})
+	if len(vals) < n && consumeValue(json[i:]) == nil {
+		// reached the end of the array, which is unterminated
+		return nil
+	}
+	return vals
+}
+
+// Slice returns a new array containing elements [start, end) of the array at
+// path in json. The elements, and any whitespace between them, are copied
+// verbatim. start and end are clamped to the bounds of the array. If path is
+// malformed or does not reference an array, Slice returns nil.
+func Slice(json []byte, path string, start, end int) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	from, to := -1, -1
+	var n int
+	forEachElement(json[i:], func(s, e int) bool {
+		if n == start || (n == 0 && start < 0) {
+			from = i + s
+		}
+		if n < end {
+			to = i + e
+		}
+		n++
+		return n < end
+	})
+	newJSON := []byte{'['}
+	if from != -1 && from < to {
+		newJSON = append(newJSON, json[from:to]...)
+	}
+	return append(newJSON, ']')
+}
+
+// AppendBatch appends each of objs to the array at path in json, contiguously
+// and in order, with a single splice. As with Set, null is treated as an
+// empty array. If objs is empty, or if path is malformed or does not
+// reference an array or null, the original json is returned. If any obj
+// cannot be marshaled, AppendBatch panics.
+func AppendBatch(json []byte, path string, objs []interface{}) []byte {
+	i := locateValue(json, path)
+	if i == -1 || len(objs) == 0 || (json[i] != '[' && json[i] != 'n') || consumeValue(json[i:]) == nil {
+		return json
+	}
+	var vals []byte
+	for k, obj := range objs {
+		if k > 0 {
+			vals = append(vals, ',')
+		}
+		vals = append(vals, marshal(obj)...)
+	}
+	if json[i] == 'n' {
+		return rewriteAt(json, i+3, "", vals, modeCopy, nil)
+	}
+	end := i + len(json[i:]) - len(consumeValue(json[i:])) - 1 // offset of ]
+	return rewriteAt(json, end, "", vals, modeCopy, nil)
+}
+
+// MergeArray overlays the elements of the array src onto the array at path in
+// dst, by index: each element of src replaces the element of the target array
+// at the same index, and any elements of src beyond the end of the target
+// array are appended to it. If path is malformed or does not reference an
+// array, or if src is not an array, the original dst is returned.
+func MergeArray(dst []byte, path string, src []byte) []byte {
+	return mergeArray(dst, path, src, false)
+}
+
+// MergeArraySkipNulls is like MergeArray, but null elements of src leave the
+// corresponding elements of the target array unchanged. null elements beyond
+// the end of the target array are still appended, so that the indices of any
+// subsequent elements are preserved.
+func MergeArraySkipNulls(dst []byte, path string, src []byte) []byte {
+	return mergeArray(dst, path, src, true)
+}
+
+func mergeArray(dst []byte, path string, src []byte, skipNulls bool) []byte {
+	i := locateValue(dst, path)
+	if i == -1 || dst[i] != '[' || consumeValue(dst[i:]) == nil {
+		return dst
+	}
+	j := locateValue(src, "")
+	if j == -1 || src[j] != '[' || consumeValue(src[j:]) == nil {
+		return dst
+	}
+	srcElems := arrayElements(src[j:])
+	var splices []splice
+	var n int
+	forEachElement(dst[i:], func(start, end int) bool {
+		if n == len(srcElems) {
+			return false
+		}
+		if e := srcElems[n]; !skipNulls || !bytes.Equal(e, []byte("null")) {
+			splices = append(splices, splice{i + start, i + end, e})
+		}
+		n++
+		return true
+	})
+	if n < len(srcElems) {
+		end := i + len(dst[i:]) - len(consumeValue(dst[i:])) - 1 // offset of ]
+		var val []byte
+		if prevChar(dst, end) != '[' {
+			val = append(val, ',')
+		}
+		val = append(val, bytes.Join(srcElems[n:], []byte(","))...)
+		splices = append(splices, splice{end, end, val})
+	}
+	return applySplices(dst, splices)
+}
+
+// InsertSorted inserts value into the array at path in json, before the first
+// element e for which less(value, e) is true, or at the end of the array if
+// there is no such element. If the array is sorted according to less, it
+// remains sorted. As with Set, null is treated as an empty array. If path is
+// malformed or does not reference an array or null, the original json is
+// returned.
+func InsertSorted(json []byte, path string, value []byte, less func(a, b []byte) bool) []byte {
+	i := locateValue(json, path)
+	if i == -1 {
+		return json
+	} else if json[i] == 'n' {
+		return rewriteAt(json, i+3, "", value, modeCopy, nil)
+	} else if json[i] != '[' || consumeValue(json[i:]) == nil {
+		return json
+	}
+	// reuse the array's existing separator, if it has one
+	at, prevEnd, sep := -1, -1, []byte(",")
+	forEachElement(json[i:], func(start, end int) bool {
+		haveSep := prevEnd != -1
+		if haveSep && len(sep) == 1 {
+			sep = json[i+prevEnd : i+start]
+		}
+		if at == -1 && less(value, json[i+start:i+end]) {
+			at = i + start
+		}
+		prevEnd = end
+		return at == -1 || !haveSep
+	})
+	if at == -1 {
+		end := i + len(json[i:]) - len(consumeValue(json[i:])) - 1 // offset of ]
+		return rewriteAt(json, end, "", value, modeCopy, nil)
+	}
+	return applySplices(json, []splice{{at, at, append(append([]byte(nil), value...), sep...)}})
+}
+
+// CoerceArray replaces each element of the array at path in json with the
+// result of calling fn on it. fn must return valid JSON. If path is malformed
+// or does not reference an array, the original json is returned.
+func CoerceArray(json []byte, path string, fn func(raw []byte) []byte) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' || consumeValue(json[i:]) == nil {
+		return json
+	}
+	var splices []splice
+	forEachElement(json[i:], func(start, end int) bool {
+		splices = append(splices, splice{i + start, i + end, fn(json[i+start : i+end])})
+		return true
+	})
+	return applySplices(json, splices)
+}
+
+// EnsureContains appends value to the array at path in json, unless the array
+// already contains an element equal to value, ignoring whitespace. As with
+// Set, null is treated as an empty array. If path is malformed or does not
+// reference an array or null, the original json is returned.
+func EnsureContains(json []byte, path string, value []byte) []byte {
+	i := locateValue(json, path)
+	if i == -1 {
+		return json
+	} else if json[i] == 'n' {
+		return rewriteAt(json, i+3, "", value, modeCopy, nil)
+	} else if json[i] != '[' || consumeValue(json[i:]) == nil {
+		return json
+	}
+	want := appendCompact(nil, value)
+	found := false
+	forEachElement(json[i:], func(start, end int) bool {
+		found = bytes.Equal(appendCompact(nil, json[i+start:i+end]), want)
+		return !found
+	})
+	if found {
+		return json
+	}
+	end := i + len(json[i:]) - len(consumeValue(json[i:])) - 1 // offset of ]
+	return rewriteAt(json, end, "", value, modeCopy, nil)
+}
+
+// FilterArray removes each element of the array at path in json for which
+// keep returns false. If path is malformed or does not reference an array,
+// the original json is returned.
+func FilterArray(json []byte, path string, keep func(raw []byte) bool) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '[' || consumeValue(json[i:]) == nil {
+		return json
+	}
+	var elems []span
+	var drop []bool
+	forEachElement(json[i:], func(start, end int) bool {
+		elems = append(elems, span{i + start, i + end})
+		drop = append(drop, !keep(json[i+start:i+end]))
+		return true
+	})
+	return applySplices(json, removeItems(elems, drop))
+}
+
+// SetPair treats the array at path in json as an ordered map of [key, value]
+// pairs, and sets the value of the first pair whose key is the string pairKey
+// to obj. If there is no such pair, [pairKey, obj] is appended to the array.
+// As with Set, null is treated as an empty array. If path is malformed or does
+// not reference an array or null, the original json is returned. If obj
+// cannot be marshaled, SetPair panics.
+func SetPair(json []byte, path, pairKey string, obj interface{}) []byte {
+	i := locateValue(json, path)
+	if i == -1 {
+		return json
+	} else if json[i] == 'n' {
+		return rewriteAt(json, i+3, "", appendPair(nil, pairKey, marshal(obj)), modeCopy, nil)
+	} else if json[i] != '[' || consumeValue(json[i:]) == nil {
+		return json
+	}
+	pair := -1
+	forEachElement(json[i:], func(start, end int) bool {
+		if json[i+start] == '[' {
+			forEachElement(json[i+start:i+end], func(kStart, kEnd int) bool {
+				k := json[i+start+kStart : i+start+kEnd]
+				if k[0] == '"' && unescapeString(k[1:len(k)-1]) == pairKey {
+					pair = i + start
+				}
+				return false // only the first element is the key
+			})
+		}
+		return pair == -1
+	})
+	val := marshal(obj)
+	if pair == -1 {
+		end := i + len(json[i:]) - len(consumeValue(json[i:])) - 1 // offset of ]
+		return rewriteAt(json, end, "", appendPair(nil, pairKey, val), modeCopy, nil)
+	}
+	var n int
+	var second span
+	forEachElement(json[pair:], func(start, end int) bool {
+		second = span{pair + start, pair + end}
+		n++
+		return n < 2
+	})
+	if n < 2 {
+		end := pair + len(json[pair:]) - len(consumeValue(json[pair:])) - 1 // offset of ]
+		return rewriteAt(json, end, "", val, modeCopy, nil)
+	}
+	return applySplices(json, []splice{{second.start, second.end, val}})
+}
+
+// appendPair appends the JSON array [key, val] to dst.
+func appendPair(dst []byte, key string, val []byte) []byte {
+	dst = append(dst, '[')
+	dst = appendEscapedString(dst, key, false)
+	dst = append(dst, ',')
+	dst = append(dst, val...)
+	return append(dst, ']')
+}
+
+// AppendToString appends suffix to the string at path in json. suffix is
+// escaped as though it were marshaled. If path is malformed or does not
+// reference a string, the original json is returned.
+func AppendToString(json []byte, path string, suffix string) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '"' {
+		return json
+	}
+	// locate closing "
+	rest := consumeString(json[i:])
+	if len(rest) == len(json[i:]) {
+		// unterminated string
+		return json
+	}
+	end := len(json) - len(rest) - 1
+	esc := marshal(suffix)
+	esc = esc[1 : len(esc)-1] // strip quotes
+
+	n := addLen(len(json), len(esc))
+	if n == -1 {
+		return json
+	}
+	newJSON := make([]byte, 0, n)
+	newJSON = append(newJSON, json[:end]...)
+	newJSON = append(newJSON, esc...)
+	newJSON = append(newJSON, json[end:]...)
+	return newJSON
+}
+
+// SetBefore inserts obj into the object containing the value at path,
+// immediately before the member whose key is beforeKey. The last accessor in
+// path is used as the new member's key. If that key already exists, its value
+// is replaced without moving it, as in Set. If path is malformed, or if the
+// object does not contain beforeKey, the original json is returned. If obj
+// cannot be marshaled, SetBefore panics.
+func SetBefore(json []byte, path, beforeKey string, obj interface{}) []byte {
+	start, isArray, ok := Parent(json, path)
+	if !ok || isArray || consumeValue(json[start:]) == nil {
+		return json
+	}
+	key := lastAccessor(path)
+	at, exists := -1, false
+	forEachMember(json[start:], func(keyStart, _, _ int) bool {
+		k, _ := parseString(json[start+keyStart:])
+		if keyEquals(k, key) {
+			exists = true
+		} else if at == -1 && keyEquals(k, beforeKey) {
+			at = start + keyStart
+		}
+		return !exists
+	})
+	if exists {
+		return Set(json, path, obj)
+	} else if at == -1 {
+		return json
+	}
+	val := appendReplacement(nil, '}', false, key, marshal(obj))
+	return applySplices(json, []splice{{at, at, append(val, ',')}})
+}
+
+// SetWhenSibling replaces the value at path in json with obj, but only if the
+// object containing that value has a member named siblingField whose value
+// is equal to siblingEquals, ignoring whitespace. Otherwise, or if path is
+// malformed, the original json is returned. If obj cannot be marshaled,
+// SetWhenSibling panics.
+func SetWhenSibling(json []byte, path, siblingField string, siblingEquals []byte, obj interface{}) []byte {
+	start, isArray, ok := Parent(json, path)
+	if !ok || isArray || consumeValue(json[start:]) == nil {
+		return json
+	}
+	i := locateAccessor(json[start:], siblingField, nil)
+	if i == -1 || json[start+i] == '}' {
+		return json
+	}
+	sibling := json[start+i:]
+	sibling = sibling[:len(sibling)-len(consumeValue(sibling))]
+	if !bytes.Equal(appendCompact(nil, sibling), appendCompact(nil, siblingEquals)) {
+		return json
+	}
+	return Set(json, path, obj)
+}
+
+// Toggle replaces the boolean at path in json with its negation. Like
+// SetRawInPlace, json is modified in place where possible, so toggling false
+// to true leaves a trailing space. If path is malformed or does not reference
+// a boolean, the original json is returned.
+func Toggle(json []byte, path string) []byte {
+	i := locateValue(json, path)
+	if i == -1 || (json[i] != 't' && json[i] != 'f') {
+		return json
+	}
+	val := []byte("true")
+	if json[i] == 't' {
+		val = []byte("false")
+	}
+	return rewriteAt(json, i, "", val, modePad, nil)
+}
+
+// SetPrefixed replaces the value of each member of the object at path in json
+// whose key, with escape sequences decoded, begins with keyPrefix with obj. If
+// path is malformed or does not reference an object, the original json is
+// returned. If obj cannot be marshaled, SetPrefixed panics.
+func SetPrefixed(json []byte, path, keyPrefix string, obj interface{}) []byte {
+	return SetPrefixedN(json, path, keyPrefix, obj, 0)
+}
+
+// SetPrefixedN is like SetPrefixed, but if limit is positive, only the first
+// limit matching members are replaced, and the remaining members are not
+// parsed. This bounds the work done on objects with many matching keys.
+func SetPrefixedN(json []byte, path, keyPrefix string, obj interface{}, limit int) []byte {
+	i := locateValue(json, path)
+	if i == -1 || json[i] != '{' || consumeValue(json[i:]) == nil {
+		return json
+	}
+	val := marshal(obj)
+	var splices []splice
+	forEachMember(json[i:], func(keyStart, valStart, valEnd int) bool {
+		if key, _ := parseString(json[i+keyStart:]); strings.HasPrefix(unescapeString(key), keyPrefix) {
+			splices = append(splices, splice{i + valStart, i + valEnd, val})
+		}
+		return limit <= 0 || len(splices) < limit
+	})
+	return applySplices(json, splices)
+}
+
+// A Cursor provides constant-time access to the elements of a top-level
+// array.
+type Cursor struct {
+	json  []byte
+	elems []span
+}
+
+// ArrayCursor scans the top-level array in json and returns a Cursor for
+// its elements. If json is not an array, ArrayCursor returns nil.
+func ArrayCursor(json []byte) *Cursor {
+	i := locateValue(json, "")
+	if i == -1 || json[i] != '[' || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	c := &Cursor{json: json}
+	forEachElement(json[i:], func(start, end int) bool {
+		c.elems = append(c.elems, span{i + start, i + end})
+		return true
+	})
+	return c
+}
+
+// Len returns the number of elements in the array.
+func (c *Cursor) Len() int {
+	return len(c.elems)
+}
+
+// Get returns element i of the array. If i is out of range, Get returns nil.
+func (c *Cursor) Get(i int) []byte {
+	if i < 0 || i >= len(c.elems) {
+		return nil
+	}
+	return c.json[c.elems[i].start:c.elems[i].end]
+}
+
+// Set replaces element i of the array with obj. The original json passed to
+// ArrayCursor is not modified. If i is out of range, Set does nothing. If obj
+// cannot be marshaled, Set panics.
+func (c *Cursor) Set(i int, obj interface{}) {
+	if i < 0 || i >= len(c.elems) {
+		return
+	}
+	e := c.elems[i]
+	val := marshal(obj)
+	c.json = applySplices(c.json, []splice{{e.start, e.end, val}})
+	// adjust offsets of subsequent elements
+	delta := len(val) - (e.end - e.start)
+	c.elems[i].end += delta
+	for j := i + 1; j < len(c.elems); j++ {
+		c.elems[j].start += delta
+		c.elems[j].end += delta
+	}
+}
+
+// Bytes returns the JSON for the array, including any modifications made by
+// Set.
+func (c *Cursor) Bytes() []byte {
+	return c.json
+}
+
+// An Op is a single modification of a JSON document: it sets the value at
+// Path to Value, which must be valid JSON.
+type Op struct {
+	Path  string
+	Value []byte
+}
+
+// Apply applies each op to json in order, as if by successive calls to Set.
+// Ops whose paths are malformed are skipped. The original json is not
+// modified. Where possible, every op is located in a single pass over json,
+// and the result is written with a single allocation.
+func Apply(json []byte, ops []Op) []byte {
+	return applyOps(json, ops, false)
+}
+
+// ApplyInPlace is the in-place analog of Apply. If every op can be located
+// in the original json, they are all written in a single pass: in place,
+// without padding, if the result is no larger than json, and otherwise with
+// a single allocation. Otherwise, the ops are applied sequentially in the
+// manner of SetRawInPlaceShrink. As with SetInPlace, the returned slice may
+// share underlying memory with json.
+func ApplyInPlace(json []byte, ops []Op) []byte {
+	return applyOps(json, ops, true)
+}
+
+// ApplyContext is like Apply, but checks ctx periodically while applying ops.
+// If ctx is done before all ops have been applied, the original json is
+// returned, along with ctx.Err().
+func ApplyContext(ctx context.Context, json []byte, ops []Op) ([]byte, error) {
+	const checkInterval = 64 // ops between checks
+	res := json
+	for len(ops) > 0 {
+		if err := ctx.Err(); err != nil {
+			return json, err
+		}
+		n := min(len(ops), checkInterval)
+		res, ops = Apply(res, ops[:n]), ops[n:]
+	}
+	return res, nil
+}
+
+func applyOps(json []byte, ops []Op, inPlace bool) []byte {
+	splices, ok := opSplices(json, ops)
+	if !ok {
+		// apply sequentially
+		mode := modeCopy
+		if inPlace {
+			mode = modeShift
+		}
+		for _, op := range ops {
+			json = rewritePathMode(json, op.Path, op.Value, mode, nil)
+		}
+		return json
+	}
+	if !inPlace || !splicesFitInPlace(splices) {
+		return applySplices(json, splices)
+	}
+	w, prev := 0, 0
+	for _, s := range splices {
+		w += copy(json[w:], json[prev:s.start])
+		w += copy(json[w:], s.val)
+		prev = s.end
+	}
+	w += copy(json[w:], json[prev:])
+	return json[:w]
+}
+
+// splicesFitInPlace reports whether splices, sorted by offset, can be written
+// left-to-right in place, i.e. whether no replacement ever overtakes the
+// unwritten remainder of the document.
+func splicesFitInPlace(splices []splice) bool {
+	var delta int
+	for _, s := range splices {
+		if delta += len(s.val) - (s.end - s.start); delta > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// InPlaceEligible reports whether ApplyInPlace can apply ops to json as a
+// single batch without growing json at any point, and thus without
+// allocating. If the ops conflict or cannot all be located, such that
+// ApplyInPlace must fall back to applying them one at a time,
+// InPlaceEligible conservatively reports false.
+func InPlaceEligible(json []byte, ops []Op) bool {
+	splices, ok := opSplices(json, ops)
+	return ok && splicesFitInPlace(splices)
+}
+
+// opSplices locates each op in json and returns the splices that apply them,
+// sorted by offset. If any op cannot be located, or if the splices conflict
+// such that applying them together would differ from applying them
+// sequentially, opSplices returns false.
+func opSplices(json []byte, ops []Op) ([]splice, bool) {
+	splices := make([]splice, 0, len(ops))
+	for _, op := range ops {
+		if op.Path == "" {
+			return nil, false
+		}
+		i, lastAcc, _ := locatePath(json, op.Path, nil)
+		if i == -1 {
+			return nil, false
+		}
+		c := json[i]
+		if c == 'l' {
+			i -= 3
+		}
+		comma := (c == '}' && prevChar(json, i) != '{') || (c == ']' && prevChar(json, i) != '[')
+		end := len(json) - len(consumeValue(json[i:]))
+		splices = append(splices, splice{i, end, appendReplacement(nil, c, comma, lastAcc, op.Value)})
+	}
+	sort.SliceStable(splices, func(a, b int) bool { return splices[a].start < splices[b].start })
+	for k := 1; k < len(splices); k++ {
+		if splices[k].start < splices[k-1].end || splices[k].start == splices[k-1].start {
+			return nil, false
+		}
+	}
+	return splices, true
+}
+
+// Diff returns ops that, when applied to a, produce a document equivalent to
+// b (ignoring whitespace). Objects with the same keys and arrays with the same
+// length are diffed member-by-member; any other difference is expressed by
+// replacing the differing value outright. Since an Op cannot remove a value, a
+// key present in a but absent from b also causes the enclosing object to be
+// replaced. The Value of each op is a copy. If either document is malformed,
+// Diff returns nil.
+func Diff(a, b []byte) []Op {
+	return DiffPath(a, b, "")
+}
+
+// DiffPath is like Diff, but diffs only the values at path in a and b. The
+// paths of the returned ops are prefixed with path. If path does not exist in
+// a, the result is a single op that sets it; if path does not exist in b, or
+// either document is malformed, DiffPath returns nil.
+func DiffPath(a, b []byte, path string) []Op {
+	bi := locateValue(b, path)
+	if bi == -1 || consumeValue(b[bi:]) == nil {
+		return nil
+	}
+	bval := b[bi : len(b)-len(consumeValue(b[bi:]))]
+	ai := locateValue(a, path)
+	if ai == -1 {
+		return []Op{{path, append([]byte(nil), bval...)}}
+	} else if consumeValue(a[ai:]) == nil {
+		return nil
+	}
+	aval := a[ai : len(a)-len(consumeValue(a[ai:]))]
+	return diffValues(aval, bval, path, nil)
+}
+
+// diffValues appends to ops the ops that transform the value a, located at
+// path, into the value b.
+func diffValues(a, b []byte, path string, ops []Op) []Op {
+	if bytes.Equal(appendCompact(nil, a), appendCompact(nil, b)) {
+		return ops
+	}
+	replace := append(ops, Op{path, append([]byte(nil), b...)})
+	switch {
+	case a[0] == '{' && b[0] == '{':
+		am, bm := Members(a, ""), Members(b, "")
+		avals := make(map[string][]byte, len(am))
+		for _, m := range am {
+			avals[m.Key] = m.Value
+		}
+		bkeys := make(map[string]bool, len(bm))
+		for _, m := range bm {
+			bkeys[m.Key] = true
+		}
+		for k := range avals {
+			if !bkeys[k] {
+				return replace
+			}
+		}
+		for _, m := range bm {
+			child := joinPath(path, escapeAccessor(m.Key))
+			if av, ok := avals[m.Key]; ok {
+				ops = diffValues(av, m.Value, child, ops)
+			} else {
+				ops = append(ops, Op{child, append([]byte(nil), m.Value...)})
+			}
+		}
+		return ops
+	case a[0] == '[' && b[0] == '[':
+		ae, be := arrayElements(a), arrayElements(b)
+		if len(ae) != len(be) {
+			return replace
+		}
+		for j := range ae {
+			ops = diffValues(ae[j], be[j], joinPath(path, strconv.Itoa(j)), ops)
+		}
+		return ops
+	default:
+		return replace
+	}
+}
+
+// arrayElements returns the elements of the array at the start of json.
+func arrayElements(json []byte) [][]byte {
+	var elems [][]byte
+	forEachElement(json, func(start, end int) bool {
+		elems = append(elems, json[start:end])
+		return true
+	})
+	return elems
+}
+
+// joinPath returns the path of the accessor acc within the value at path.
+func joinPath(path, acc string) string {
+	if path == "" {
+		return acc
+	}
+	return path + "." + acc
+}
+
+// DropNulls removes each object member in json whose value is null, at any
+// depth. null array elements are left in place, since removing them would
+// change the indices of subsequent elements. If json contains no such
+// members, it is returned unmodified.
+func DropNulls(json []byte) []byte {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return json
+	}
+	splices := dropNulls(json, i, nil)
+	sort.Slice(splices, func(a, b int) bool { return splices[a].start < splices[b].start })
+	return applySplices(json, splices)
+}
+
+// dropNulls appends to splices the splices that remove each null object
+// member within the value at json[i:]. The returned splices are not sorted.
+func dropNulls(json []byte, i int, splices []splice) []splice {
+	switch json[i] {
+	case '{':
+		var members []span
+		var drop []bool
+		forEachMember(json[i:], func(keyStart, valStart, valEnd int) bool {
+			isNull := json[i+valStart] == 'n'
+			members = append(members, span{i + keyStart, i + valEnd})
+			drop = append(drop, isNull)
+			if !isNull {
+				splices = dropNulls(json, i+valStart, splices)
+			}
+			return true
+		})
+		splices = append(splices, removeItems(members, drop)...)
+	case '[':
+		forEachElement(json[i:], func(start, end int) bool {
+			splices = dropNulls(json, i+start, splices)
+			return true
+		})
+	}
+	return splices
+}
+
+// PathOf returns the path of the first value in json, in document order, that
+// is equal to value, ignoring whitespace outside of strings. A value matches
+// before any of its children. If json itself matches, the path is "". If no
+// value matches, or json is empty or unterminated, PathOf returns false.
+func PathOf(json []byte, value []byte) (string, bool) {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return "", false
+	}
+	return pathOf(json, i, "", appendCompact(nil, value))
+}
+
+// pathOf searches the value at json[i:] for want, which must be compact.
+// prefix is the path of the value.
+func pathOf(json []byte, i int, prefix string, want []byte) (path string, ok bool) {
+	end := len(json) - len(consumeValue(json[i:]))
+	if bytes.Equal(appendCompact(nil, json[i:end]), want) {
+		return prefix, true
+	}
+	join := func(acc string) string {
+		if prefix == "" {
+			return acc
+		}
+		return prefix + "." + acc
+	}
+	switch json[i] {
+	case '{':
+		forEachMember(json[i:], func(keyStart, valStart, valEnd int) bool {
+			key, _ := parseString(json[i+keyStart:])
+			path, ok = pathOf(json, i+valStart, join(escapeAccessor(unescapeString(key))), want)
+			return !ok
+		})
+	case '[':
+		var n int
+		forEachElement(json[i:], func(start, end int) bool {
+			path, ok = pathOf(json, i+start, join(strconv.Itoa(n)), want)
+			n++
+			return !ok
+		})
+	}
+	return path, ok
+}
+
+// HasKey reports whether any object within json, at any depth, has a member
+// whose key, once its escape sequences are decoded, is equal to key.
+func HasKey(json []byte, key string) bool {
+	i := locateValue(json, "")
+	return i != -1 && consumeValue(json[i:]) != nil && hasKey(json, i, key)
+}
+
+func hasKey(json []byte, i int, key string) (found bool) {
+	switch json[i] {
+	case '{':
+		forEachMember(json[i:], func(keyStart, valStart, _ int) bool {
+			k, _ := parseString(json[i+keyStart:])
+			found = keyEquals(k, key) || hasKey(json, i+valStart, key)
+			return !found
+		})
+	case '[':
+		forEachElement(json[i:], func(start, _ int) bool {
+			found = hasKey(json, i+start, key)
+			return !found
+		})
+	}
+	return found
+}
+
+// LeafValues returns every value in json, in document order, that is not an
+// object or array and has the given Kind. If json is empty or unterminated,
+// LeafValues returns nil.
+func LeafValues(json []byte, kind Kind) [][]byte {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	var vals [][]byte
+	for _, l := range leafSpans(json, i, nil) {
+		if kindOf(json[l.start:]) == kind {
+			vals = append(vals, json[l.start:l.end])
+		}
+	}
+	return vals
+}
+
+// SetAllLeaves replaces every value in json that is not an object or array
+// with obj, preserving the structure of json. If json is empty or
+// unterminated, the original json is returned. If obj cannot be marshaled,
+// SetAllLeaves panics.
+func SetAllLeaves(json []byte, obj interface{}) []byte {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return json
+	}
+	val := marshal(obj)
+	leaves := leafSpans(json, i, nil)
+	splices := make([]splice, len(leaves))
+	for j, l := range leaves {
+		splices[j] = splice{l.start, l.end, val}
+	}
+	return applySplices(json, splices)
+}
+
+// ReplaceInStrings replaces every match of re within the decoded contents of
+// each string value in json with repl, as in regexp.Regexp.ReplaceAllString,
+// and re-escapes the result. Object keys are left untouched, as are strings
+// that contain no match. If json is empty or unterminated, the original json
+// is returned.
+func ReplaceInStrings(json []byte, re *regexp.Regexp, repl string) []byte {
+	return replaceInStrings(json, re, repl, false)
+}
+
+// ReplaceInStringsAndKeys is like ReplaceInStrings, but object keys are
+// rewritten as well.
+func ReplaceInStringsAndKeys(json []byte, re *regexp.Regexp, repl string) []byte {
+	return replaceInStrings(json, re, repl, true)
+}
+
+func replaceInStrings(json []byte, re *regexp.Regexp, repl string, keys bool) []byte {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return json
+	}
+	var splices []splice
+	for _, l := range stringSpans(json, i, keys, nil) {
+		s := unescapeString(json[l.start+1 : l.end-1])
+		if !re.MatchString(s) {
+			continue
+		}
+		val := appendEscapedString(nil, re.ReplaceAllString(s, repl), false)
+		splices = append(splices, splice{l.start, l.end, val})
+	}
+	return applySplices(json, splices)
+}
+
+// stringSpans appends to spans the span of each string within the value at
+// json[i:], in document order. If keys is true, the spans of object keys are
+// included as well.
+func stringSpans(json []byte, i int, keys bool, spans []span) []span {
+	switch json[i] {
+	case '{':
+		forEachMember(json[i:], func(keyStart, valStart, _ int) bool {
+			if keys {
+				ks := i + keyStart
+				spans = append(spans, span{ks, len(json) - len(consumeString(json[ks:]))})
+			}
+			spans = stringSpans(json, i+valStart, keys, spans)
+			return true
+		})
+	case '[':
+		forEachElement(json[i:], func(start, _ int) bool {
+			spans = stringSpans(json, i+start, keys, spans)
+			return true
+		})
+	case '"':
+		spans = append(spans, span{i, len(json) - len(consumeString(json[i:]))})
+	}
+	return spans
+}
+
+// DocumentStats holds the number of values of each Kind in a JSON document,
+// as reported by Stats.
+type DocumentStats struct {
+	Objects  int
+	Arrays   int
+	Strings  int
+	Numbers  int
+	Booleans int
+	Nulls    int
+}
+
+// Stats counts the values of each kind in json, including the root value and
+// all nested values. If json is empty or unterminated, Stats returns the zero
+// DocumentStats.
+func Stats(json []byte) DocumentStats {
+	var s DocumentStats
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return s
+	}
+	countValues(json, i, &s)
+	return s
+}
+
+// countValues adds the value at json[i:], and all values nested within it, to
+// s.
+func countValues(json []byte, i int, s *DocumentStats) {
+	switch json[i] {
+	case '{':
+		s.Objects++
+		forEachMember(json[i:], func(_, valStart, _ int) bool {
+			countValues(json, i+valStart, s)
+			return true
+		})
+	case '[':
+		s.Arrays++
+		forEachElement(json[i:], func(start, _ int) bool {
+			countValues(json, i+start, s)
+			return true
+		})
+	case '"':
+		s.Strings++
+	case 't', 'f':
+		s.Booleans++
+	case 'n':
+		s.Nulls++
+	default:
+		s.Numbers++
+	}
+}
+
+// MaxDepth returns the deepest level of object and array nesting in json. A
+// scalar has depth 0, and {} and [] have depth 1. If json is empty or
+// unterminated, MaxDepth returns 0.
+func MaxDepth(json []byte) int {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return 0
+	}
+	var depth, peak int
+	for rest := json[i:]; ; {
+		j := bytes.IndexAny(rest, `{}[]"`)
+		if j == -1 {
+			return peak
+		}
+		switch rest = rest[j:]; rest[0] {
+		case '{', '[':
+			depth++
+			peak = max(peak, depth)
+			rest = rest[1:]
+		case '}', ']':
+			if depth--; depth == 0 {
+				return peak
+			}
+			rest = rest[1:]
+		case '"':
+			rest = consumeString(rest)
+		}
+	}
+}
+
+// A TokenKind is the type of a Token.
+type TokenKind int
+
+// The possible kinds of Token. Separators (: and ,) are not tokens.
+const (
+	TokenObjectStart TokenKind = iota
+	TokenObjectEnd
+	TokenArrayStart
+	TokenArrayEnd
+	TokenKey
+	TokenString
+	TokenNumber
+	TokenBool
+	TokenNull
+)
+
+// A Token is a single structural element or scalar value of a JSON document.
+type Token struct {
+	Kind   TokenKind
+	Offset int    // offset of Raw in the document
+	Raw    []byte // as it appears in the document, e.g. with quotes and escapes
+}
+
+// Tokenize returns the tokens of the value in json, in document order. Raw
+// aliases json. If json is empty or unterminated, Tokenize returns nil.
+func Tokenize(json []byte) []Token {
+	i := locateValue(json, "")
+	if i == -1 || consumeValue(json[i:]) == nil {
+		return nil
+	}
+	return appendTokens(nil, json, i)
+}
+
+// appendTokens appends the tokens of the value at json[i:] to toks.
+func appendTokens(toks []Token, json []byte, i int) []Token {
+	end := len(json) - len(consumeValue(json[i:]))
+	switch json[i] {
+	case '{':
+		toks = append(toks, Token{TokenObjectStart, i, json[i : i+1]})
+		forEachMember(json[i:], func(keyStart, valStart, _ int) bool {
+			ks := i + keyStart
+			toks = append(toks, Token{TokenKey, ks, json[ks : len(json)-len(consumeString(json[ks:]))]})
+			toks = appendTokens(toks, json, i+valStart)
+			return true
+		})
+		return append(toks, Token{TokenObjectEnd, end - 1, json[end-1 : end]})
+	case '[':
+		toks = append(toks, Token{TokenArrayStart, i, json[i : i+1]})
+		forEachElement(json[i:], func(start, _ int) bool {
+			toks = appendTokens(toks, json, i+start)
+			return true
+		})
+		return append(toks, Token{TokenArrayEnd, end - 1, json[end-1 : end]})
+	case '"':
+		return append(toks, Token{TokenString, i, json[i:end]})
+	case 't', 'f':
+		return append(toks, Token{TokenBool, i, json[i:end]})
+	case 'n':
+		return append(toks, Token{TokenNull, i, json[i:end]})
+	default:
+		return append(toks, Token{TokenNumber, i, json[i:end]})
+	}
+}
+
+// leafSpans appends to spans the span of each value within the value at
+// json[i:] that is not an object or array, in document order.
+func leafSpans(json []byte, i int, spans []span) []span {
+	switch json[i] {
+	case '{':
+		forEachMember(json[i:], func(_, valStart, _ int) bool {
+			spans = leafSpans(json, i+valStart, spans)
+			return true
+		})
+	case '[':
+		forEachElement(json[i:], func(start, _ int) bool {
+			spans = leafSpans(json, i+start, spans)
+			return true
+		})
+	default:
+		spans = append(spans, span{i, len(json) - len(consumeValue(json[i:]))})
+	}
+	return spans
+}
+
+// appendCompact appends json to dst with all whitespace outside of strings
+// removed.
+func appendCompact(dst []byte, json []byte) []byte {
+	inString, skip := false, false
+	for _, c := range json {
+		if inString {
+			if skip {
+				skip = false
+			} else if c == '\\' {
+				skip = true
+			} else if c == '"' {
+				inString = false
+			}
+		} else if c == '"' {
+			inString = true
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// UnescapeUnicode replaces each \uXXXX escape sequence in the strings (and
+// keys) of json with the literal UTF-8 encoding of the character it
+// represents, combining surrogate pairs. Escapes for characters that must
+// remain escaped -- ", \, and control characters -- are left in place, as are
+// escapes for unprintable characters and unpaired surrogates. If json
+// contains no \u escapes, it is returned unmodified.
+func UnescapeUnicode(json []byte) []byte {
+	if !bytes.Contains(json, []byte(`\u`)) {
+		return json
+	}
+	out := make([]byte, 0, len(json))
+	inString := false
+	for i := 0; i < len(json); i++ {
+		c := json[i]
+		switch {
+		case !inString:
+			inString = c == '"'
+		case c == '"':
+			inString = false
+		case c == '\\' && i+1 < len(json):
+			r, n := decodeUnicodeEscape(json[i:])
+			if n == 0 || r == '"' || r == '\\' || !strconv.IsPrint(r) ||
+				(r == utf8.RuneError && utf16.IsSurrogate(parseUnicodeEscape(json[i:]))) {
+				// copy the escape sequence verbatim
+				out = append(out, c, json[i+1])
+				i++
+				continue
+			}
+			out = utf8.AppendRune(out, r)
+			i += n - 1
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// StripComments returns a copy of json with all // line comments and /* */
+// block comments removed, turning JSONC into standard JSON. Comment-like
+// sequences inside strings are preserved, as is the newline that terminates a
+// line comment. If json contains an unterminated string or block comment, the
+// original json is returned.
+func StripComments(json []byte) []byte {
+	out := make([]byte, 0, len(json))
+	for i := 0; i < len(json); {
+		switch {
+		case json[i] == '"':
+			rest := consumeString(json[i:])
+			if len(rest) == len(json[i:]) {
+				return json // unterminated string
+			}
+			end := len(json) - len(rest)
+			out = append(out, json[i:end]...)
+			i = end
+		case bytes.HasPrefix(json[i:], []byte("//")):
+			if j := bytes.IndexByte(json[i:], '\n'); j != -1 {
+				i += j
+			} else {
+				i = len(json)
+			}
+		case bytes.HasPrefix(json[i:], []byte("/*")):
+			j := bytes.Index(json[i+2:], []byte("*/"))
+			if j == -1 {
+				return json // unterminated comment
+			}
+			i += 2 + j + 2
+		default:
+			out = append(out, json[i])
+			i++
+		}
+	}
+	return out
+}
+
+// Validate returns an error if json is not a single valid JSON value,
+// optionally surrounded by whitespace. Unlike the Set functions, which
+// inspect only as much of json as necessary, Validate checks every byte.
+func Validate(json []byte) error {
+	return ValidateOpts(json, nil)
+}
+
+// ValidateOpts is like Validate, but applies the validation options in opts.
+// If opts is nil, ValidateOpts is equivalent to Validate.
+func ValidateOpts(json []byte, opts *Options) error {
+	i, err := validateValue(json, skipWhitespace(json, 0), opts)
+	if err != nil {
+		return err
+	} else if i = skipWhitespace(json, i); i != len(json) {
+		return syntaxError(json, i)
+	}
+	return nil
+}
+
+// syntaxError returns an error describing the unexpected byte at json[i].
+func syntaxError(json []byte, i int) error {
+	if i >= len(json) {
+		return fmt.Errorf("mjson: unexpected end of JSON input")
+	}
+	return fmt.Errorf("mjson: invalid character %q at offset %v", json[i], i)
+}
+
+// skipWhitespace returns the offset of the first non-whitespace byte in json
+// at or after i.
+func skipWhitespace(json []byte, i int) int {
+	return len(json) - len(consumeWhitespace(json[i:]))
+}
+
+// validateValue validates the value beginning at json[i], returning the
+// offset immediately after it. opts may be nil.
+func validateValue(json []byte, i int, opts *Options) (int, error) {
+	if i >= len(json) {
+		return i, syntaxError(json, i)
+	}
+	switch c := json[i]; {
+	case c == '{':
+		return validateObject(json, i, opts)
+	case c == '[':
+		return validateArray(json, i, opts)
+	case c == '"':
+		return validateString(json, i)
+	case c == 't':
+		return validateLiteral(json, i, "true")
+	case c == 'f':
+		return validateLiteral(json, i, "false")
+	case c == 'n':
+		return validateLiteral(json, i, "null")
+	case c == '-' || ('0' <= c && c <= '9'):
+		return validateNumber(json, i)
+	default:
+		return i, syntaxError(json, i)
+	}
+}
+
+func validateObject(json []byte, i int, opts *Options) (int, error) {
+	i = skipWhitespace(json, i+1) // consume {
+	if i < len(json) && json[i] == '}' {
+		return i + 1, nil
+	}
+	var seen map[string]bool
+	if opts != nil && opts.RejectDuplicateKeys {
+		seen = make(map[string]bool)
+	}
+	for {
+		if i >= len(json) || json[i] != '"' {
+			return i, syntaxError(json, i)
+		}
+		keyStart := i
+		var err error
+		if i, err = validateString(json, i); err != nil {
+			return i, err
+		}
+		if seen != nil {
+			key := unescapeString(json[keyStart+1 : i-1])
+			if seen[key] {
+				return keyStart, fmt.Errorf("mjson: duplicate key %q at offset %v", key, keyStart)
+			}
+			seen[key] = true
+		}
+		if i = skipWhitespace(json, i); i >= len(json) || json[i] != ':' {
+			return i, syntaxError(json, i)
+		}
+		if i, err = validateValue(json, skipWhitespace(json, i+1), opts); err != nil {
+			return i, err
+		}
+		if i = skipWhitespace(json, i); i >= len(json) {
+			return i, syntaxError(json, i)
+		} else if json[i] == '}' {
+			return i + 1, nil
+		} else if json[i] != ',' {
+			return i, syntaxError(json, i)
+		}
+		i = skipWhitespace(json, i+1) // consume ,
+	}
+}
+
+func validateArray(json []byte, i int, opts *Options) (int, error) {
+	i = skipWhitespace(json, i+1) // consume [
+	if i < len(json) && json[i] == ']' {
+		return i + 1, nil
+	}
+	for {
+		var err error
+		if i, err = validateValue(json, i, opts); err != nil {
+			return i, err
+		}
+		if i = skipWhitespace(json, i); i >= len(json) {
+			return i, syntaxError(json, i)
+		} else if json[i] == ']' {
+			return i + 1, nil
+		} else if json[i] != ',' {
+			return i, syntaxError(json, i)
+		}
+		i = skipWhitespace(json, i+1) // consume ,
+	}
+}
+
+func validateString(json []byte, i int) (int, error) {
+	for i++; i < len(json); i++ { // consume "
+		switch c := json[i]; {
+		case c == '"':
+			return i + 1, nil
+		case c < ' ':
+			return i, syntaxError(json, i)
+		case c == '\\':
+			if i++; i >= len(json) {
+				return i, syntaxError(json, i)
+			}
+			switch json[i] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				for j := 0; j < 4; j++ {
+					if i++; i >= len(json) || !isHex(json[i]) {
+						return i, syntaxError(json, i)
+					}
+				}
+			default:
+				return i, syntaxError(json, i)
+			}
+		}
+	}
+	return i, syntaxError(json, i)
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func validateLiteral(json []byte, i int, lit string) (int, error) {
+	for j := 0; j < len(lit); j++ {
+		if i+j >= len(json) || json[i+j] != lit[j] {
+			return i + j, syntaxError(json, i+j)
+		}
+	}
+	return i + len(lit), nil
+}
+
+func validateNumber(json []byte, i int) (int, error) {
+	digits := func(i int) int {
+		for i < len(json) && '0' <= json[i] && json[i] <= '9' {
+			i++
+		}
+		return i
+	}
+	if json[i] == '-' {
+		i++
+	}
+	// integer part: 0, or a nonzero digit followed by any digits
+	if i < len(json) && json[i] == '0' {
+		i++
+	} else if j := digits(i); j > i {
+		i = j
+	} else {
+		return i, syntaxError(json, i)
+	}
+	// fraction
+	if i < len(json) && json[i] == '.' {
+		j := digits(i + 1)
+		if j == i+1 {
+			return j, syntaxError(json, j)
+		}
+		i = j
+	}
+	// exponent
+	if i < len(json) && (json[i] == 'e' || json[i] == 'E') {
+		i++
+		if i < len(json) && (json[i] == '+' || json[i] == '-') {
+			i++
+		}
+		j := digits(i)
+		if j == i {
+			return j, syntaxError(json, j)
+		}
+		i = j
+	}
+	return i, nil
+}
+
+// A Builder constructs a JSON document by appending tokens to an internal
+// buffer. Separators are inserted automatically. The Builder does not check
+// that tokens are written in a valid order; for example, calling Int twice
+// within an object produces invalid JSON.
+//
+// The zero value is an empty Builder ready to use.
+type Builder struct {
+	buf []byte
+	sep bool // whether the next key or value must be preceded by a ,
+}
+
+// beginValue writes a separator if the next value requires one.
+func (b *Builder) beginValue() {
+	if b.sep {
+		b.buf = append(b.buf, ',')
+	}
+	b.sep = true
+}
+
+// Object begins an object.
+func (b *Builder) Object() {
+	b.beginValue()
+	b.buf = append(b.buf, '{')
+	b.sep = false
+}
+
+// EndObject ends the current object.
+func (b *Builder) EndObject() {
+	b.buf = append(b.buf, '}')
+	b.sep = true
+}
+
+// Array begins an array.
+func (b *Builder) Array() {
+	b.beginValue()
+	b.buf = append(b.buf, '[')
+	b.sep = false
+}
+
+// EndArray ends the current array.
+func (b *Builder) EndArray() {
+	b.buf = append(b.buf, ']')
+	b.sep = true
+}
+
+// Key writes an object key. It must be followed by exactly one value.
+func (b *Builder) Key(key string) {
+	b.beginValue()
+	b.buf = AppendEscapedString(b.buf, key)
+	b.buf = append(b.buf, ':')
+	b.sep = false
+}
+
+// String writes a string value.
+func (b *Builder) String(s string) {
+	b.beginValue()
+	b.buf = AppendEscapedString(b.buf, s)
+}
+
+// Int writes an integer value.
+func (b *Builder) Int(i int64) {
+	b.beginValue()
+	b.buf = strconv.AppendInt(b.buf, i, 10)
+}
+
+// Float writes a floating-point value, formatted as by Set. f must not be NaN
+// or infinite.
+func (b *Builder) Float(f float64) {
+	b.beginValue()
+	b.buf = strconv.AppendFloat(b.buf, f, 'f', -1, 64)
+}
+
+// Bool writes a boolean value.
+func (b *Builder) Bool(v bool) {
+	b.beginValue()
+	b.buf = strconv.AppendBool(b.buf, v)
+}
+
+// Null writes a null value.
+func (b *Builder) Null() {
+	b.beginValue()
+	b.buf = append(b.buf, "null"...)
+}
+
+// Raw writes val, which must be valid JSON, verbatim.
+func (b *Builder) Raw(val []byte) {
+	b.beginValue()
+	b.buf = append(b.buf, val...)
+}
+
+// Value writes the JSON encoding of obj, as produced by Set. If obj cannot be
+// marshaled, Value panics.
+func (b *Builder) Value(obj interface{}) {
+	b.Raw(marshal(obj))
+}
+
+// Bytes returns the document built so far. The returned slice aliases the
+// Builder's buffer, and is only valid until the next call to a Builder
+// method.
+func (b *Builder) Bytes() []byte {
+	return b.buf
+}
+
+// Reset empties the Builder, retaining its buffer for reuse.
+func (b *Builder) Reset() {
+	b.buf = b.buf[:0]
+	b.sep = false
+}
+
+// A Kind is the type of a JSON value.
+type Kind int
+
+// The possible kinds of a JSON value. Invalid is returned for values that do
+// not begin with a valid JSON token.
+const (
+	Invalid Kind = iota
+	Null
+	Bool
+	Number
+	String
+	Array
+	Object
+)
+
+var kindNames = [...]string{
+	Invalid: "invalid",
+	Null:    "null",
+	Bool:    "bool",
+	Number:  "number",
+	String:  "string",
+	Array:   "array",
+	Object:  "object",
+}
+
+// String implements fmt.Stringer.
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return "Kind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return kindNames[k]
+}
+
+// A Mode describes how Set would modify a document, as reported by SetMode.
+type Mode int
+
+// The possible effects of Set. NoOp indicates that the path is malformed, so
+// Set would return the original document.
+const (
+	NoOp        Mode = iota
+	Overwrite        // replace an existing value
+	InsertKey        // add a new member to an object
+	AppendArray      // add a new element to the end of an array
+	ConvertNull      // replace null with a single-element array
+)
+
+// SetMode reports how Set would modify json if called with path, without
+// modifying it.
+func SetMode(json []byte, path string) Mode {
+	if path == "" {
+		if i := locateValue(json, ""); i != -1 && (json[i] == '}' || json[i] == ']' || json[i] == 'l') {
+			return NoOp
+		}
+		return Overwrite
+	}
+	i, _, _ := locatePath(json, path, nil)
+	if i == -1 {
+		return NoOp
+	}
+	switch json[i] {
+	case '}':
+		return InsertKey
+	case ']':
+		return AppendArray
+	case 'l':
+		return ConvertNull
+	default:
+		return Overwrite
+	}
+}
+
+// RootKind returns the Kind of the top-level value in json.
+func RootKind(json []byte) Kind {
+	return kindOf(consumeWhitespace(json))
+}
+
+// Type returns the Kind of the value at path in json. If path is malformed,
+// Type returns Invalid.
+func Type(json []byte, path string) Kind {
+	i := locateValue(json, path)
+	if i == -1 {
+		return Invalid
+	}
+	return kindOf(json[i:])
+}
+
+// GetTyped returns the value at path in json, as returned by Get, along with
+// its Kind. If path is malformed, ok is false.
+func GetTyped(json []byte, path string) (raw []byte, kind Kind, ok bool) {
+	i := locateValue(json, path)
+	if i == -1 {
+		return nil, Invalid, false
+	}
+	rest := consumeValue(json[i:])
+	if rest == nil {
+		return nil, Invalid, false
+	}
+	return json[i : len(json)-len(rest)], kindOf(json[i:]), true
+}
+
+// GetIntChecked returns the number at path in json as an int64. Unlike a plain
+// conversion, it never loses precision: an error is returned if the number
+// has a fractional part or lies outside the range of an int64, as well as if
+// path is malformed or does not reference a number. Integral numbers written
+// with a fraction or exponent, such as 1.0 or 1e3, are accepted.
+func GetIntChecked(json []byte, path string) (int64, error) {
+	raw, kind, ok := GetTyped(json, path)
+	if !ok {
+		return 0, fmt.Errorf("mjson: malformed path %q", path)
+	} else if kind != Number {
+		return 0, fmt.Errorf("mjson: value at %q is %v, not a number", path, kind)
+	}
+	n, err := strconv.ParseInt(string(raw), 10, 64)
+	if err == nil {
+		return n, nil
+	} else if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("mjson: number %s at %q overflows int64", raw, path)
+	}
+	digits, integral, inRange := integerDigits(string(raw))
+	if !integral {
+		return 0, fmt.Errorf("mjson: number %s at %q is not an integer", raw, path)
+	} else if !inRange {
+		return 0, fmt.Errorf("mjson: number %s at %q overflows int64", raw, path)
+	}
+	n, err = strconv.ParseInt(digits, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("mjson: number %s at %q overflows int64", raw, path)
+	} else if err != nil {
+		return 0, fmt.Errorf("mjson: invalid number %s at %q", raw, path)
+	}
+	return n, nil
+}
+
+// integerDigits rewrites the JSON number num, which may have a fraction or
+// exponent, as a plain decimal integer, working on the decimal text so that
+// no precision is lost. integral is false if num has a non-zero fractional
+// part. inRange is false if num has more than 19 integer digits, and so
+// cannot fit in an int64; otherwise, digits may still overflow an int64, and
+// must be checked with strconv.ParseInt.
+func integerDigits(num string) (digits string, integral, inRange bool) {
+	var sign string
+	if strings.HasPrefix(num, "-") {
+		sign, num = "-", num[1:]
+	}
+	mant, exp := num, ""
+	if i := strings.IndexAny(num, "eE"); i >= 0 {
+		mant, exp = num[:i], num[i+1:]
+	}
+	intPart, frac := mant, ""
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		intPart, frac = mant[:i], mant[i+1:]
+	}
+	// strip leading zeros, tracking the position of the decimal point
+	digits = strings.TrimLeft(intPart+frac, "0")
+	point := len(digits) - len(frac)
+	if digits == "" {
+		return "0", true, true
+	}
+	e := 0
+	if exp != "" {
+		var err error
+		if e, err = strconv.Atoi(exp); err != nil {
+			// exponent is too large to represent; its sign decides
+			return "", !strings.HasPrefix(exp, "-"), false
+		}
+	}
+	const maxDigits = 19 // len("9223372036854775808")
+	if e > maxDigits-point {
+		return "", true, false
+	} else if e <= -point {
+		return "", false, true // 0 < |num| < 1
+	}
+	point += e
+	if point < len(digits) {
+		if strings.TrimRight(digits[point:], "0") != "" {
+			return "", false, true
+		}
+		digits = digits[:point]
+	} else {
+		digits += strings.Repeat("0", point-len(digits))
+	}
+	return sign + digits, true, true
+}
+
+// IsEmpty reports whether the value at path in json is an empty string,
+// array, or object, null, or a number equal to zero. If path is malformed,
+// IsEmpty returns false.
+func IsEmpty(json []byte, path string) bool {
+	val, kind, ok := GetTyped(json, path)
+	if !ok {
+		return false
+	}
+	switch kind {
+	case Null:
+		return true
+	case String:
+		return len(val) == 2
+	case Array, Object:
+		return len(consumeWhitespace(val[1:])) == 1
+	case Number:
+		f, err := strconv.ParseFloat(string(val), 64)
+		return err == nil && f == 0
+	}
+	return false
+}
+
+// IsContainer reports whether the value at path in json is an object or an
+// array. If path is malformed, IsContainer returns false.
+func IsContainer(json []byte, path string) bool {
+	k := Type(json, path)
+	return k == Object || k == Array
+}
+
+// kindOf returns the Kind of the value at the start of json. Like
+// consumeValue, it only inspects the first byte of the value.
+func kindOf(json []byte) Kind {
+	if len(json) == 0 {
+		return Invalid
+	}
+	switch c := json[0]; c {
+	case '{':
+		return Object
+	case '[':
+		return Array
+	case '"':
+		return String
+	case 't', 'f':
+		return Bool
+	case 'n':
+		return Null
+	default:
+		if c == '-' || ('0' <= c && c <= '9') {
+			return Number
+		}
+		return Invalid
+	}
+}
+
+// A Template is a path containing placeholders, written as {}, that are
+// filled in with accessors each time the Template is applied.
+type Template struct {
+	accs         []string
+	placeholders int
+}
+
+// CompileTemplate parses path into a Template. Each accessor in path that is
+// exactly {} is a placeholder.
+func CompileTemplate(path string) *Template {
+	t := new(Template)
+	for path != "" {
+		acc, rest, last := nextAccessor(path)
+		if acc == "{}" {
+			t.placeholders++
+		}
+		t.accs = append(t.accs, acc)
+		if last {
+			break
+		}
+		path = rest
+	}
+	return t
+}
+
+// Set replaces the value at the path described by t in json with obj,
+// substituting each placeholder with the corresponding element of args. Each
+// element of args must be a string or an int. If len(args) does not match the
+// number of placeholders in t, or if the resulting path is malformed, the
+// original json is returned. If obj cannot be marshaled, Set panics.
+func (t *Template) Set(json []byte, args []interface{}, obj interface{}) []byte {
+	if len(args) != t.placeholders {
+		return json
+	} else if len(t.accs) == 0 {
+		return rewritePath(json, "", marshal(obj), false)
+	}
+
+	var i int
+	var acc string
+	for j := range t.accs {
+		if acc = t.accs[j]; acc == "{}" {
+			switch arg := args[0].(type) {
+			case string:
+				acc = arg
+			case int:
+				acc = strconv.Itoa(arg)
+			default:
+				return json
+			}
+			args = args[1:]
+		}
+		if i = seekAccessor(json, i, acc, j == len(t.accs)-1, nil); i == -1 {
+			return json
+		}
+	}
+	return rewriteAt(json, i, acc, marshal(obj), modeCopy, nil)
+}
+
+// rewritePath replaces the value at path in json with val. If inPlace is
+// true, the returned slice may share underlying memory with json. If path is
+// malformed, the original json is returned.
+func rewritePath(json []byte, path string, val []byte, inPlace bool) []byte {
+	mode := modeCopy
+	if inPlace {
+		mode = modePad
+	}
+	return rewritePathMode(json, path, val, mode, nil)
+}
+
+// A rewriteMode determines whether a rewrite may modify json in place, and
+// how space is reclaimed when the new value is smaller than the old.
+type rewriteMode int
+
+const (
+	// modeCopy always allocates a new slice.
+	modeCopy rewriteMode = iota
+	// modePad modifies json in place where possible, padding smaller values
+	// with whitespace.
+	modePad
+	// modeShift modifies json in place where possible, shifting the rest of
+	// json left over the space freed by smaller values.
+	modeShift
+)
+
+// rewritePathMode replaces the value at path in json with val according to
+// mode and opts. If path is malformed, the original json is returned.
+func rewritePathMode(json []byte, path string, val []byte, mode rewriteMode, opts *Options) []byte {
+	if path == "" {
+		// replace the root value, preserving any surrounding whitespace
+		if i := len(json) - len(consumeWhitespace(json)); i < len(json) {
+			if json[i] == '}' || json[i] == ']' || json[i] == 'l' {
+				// rewriteAt would treat these as append offsets
+				return json
+			} else if mode == modePad {
+				// there is nothing to preserve the offsets of, so reclaim
+				// space instead of padding
+				mode = modeShift
+			}
+			return rewriteAt(json, i, "", val, mode, opts)
+		} else if opts.tooLarge(len(val)) {
+			return json
+		} else if mode != modeCopy {
+			return append(json[:0], val...)
+		}
+		return append([]byte(nil), val...)
+	}
+	if opts != nil && opts.CreatePath && len(consumeWhitespace(json)) == 0 {
+		// treat json as an empty object or array
+		if val = buildPath(path, val); val == nil || opts.tooLarge(len(val)) {
+			return json
+		} else if mode != modeCopy {
+			return append(json[:0], val...)
+		}
+		return val
+	}
+	i, lastAcc, rest := locatePath(json, path, opts)
+	if i == -1 {
+		// not found; return unmodified
+		return json
+	} else if rest != "" {
+		// create the rest of the path
+		if val = buildPath(rest, val); val == nil {
+			return json
+		}
+	}
+	if opts != nil && opts.DedupeOnSet && rest == "" && json[i] != '}' && json[i] != ']' && json[i] != 'l' {
+		// the parent precedes i, so its offset is unaffected by the rewrite
+		if start := locateParent(json, path, opts); start != -1 && json[start] == '{' && consumeValue(json[start:]) != nil {
+			return dedupeKey(rewriteAt(json, i, lastAcc, val, mode, opts), start, lastAcc, opts)
+		}
+	}
+	return rewriteAt(json, i, lastAcc, val, mode, opts)
+}
+
+// locateParent returns the offset of the value containing the value at path
+// in json, or -1 if it cannot be located.
+func locateParent(json []byte, path string, opts *Options) int {
+	if parent := parentPath(path); parent != "" {
+		i, _, _ := locatePath(json, parent, opts)
+		return i
+	}
+	return len(json) - len(consumeWhitespace(json))
+}
+
+// parentPath returns path without its last accessor.
+func parentPath(path string) string {
+	var parent string
+	for rest := path; ; {
+		_, r, last := splitAccessor(rest)
+		if last {
+			return parent
+		}
+		parent, rest = path[:len(path)-len(r)-1], r
+	}
+}
+
+// dedupeKey removes each member of the object at json[start:], other than
+// the first, whose key matches key.
+func dedupeKey(json []byte, start int, key string, opts *Options) []byte {
+	var members []span
+	var drop []bool
+	var seen bool
+	forEachMember(json[start:], func(keyStart, _, valEnd int) bool {
+		k, _ := parseString(json[start+keyStart:])
+		match := opts.keyMatches(k, key)
+		members = append(members, span{start + keyStart, start + valEnd})
+		drop = append(drop, match && seen)
+		seen = seen || match
+		return true
+	})
+	return applySplices(json, removeItems(members, drop))
+}
 
-// Set replaces the value at path in json with obj. If path is malformed, the
-// original json is returned. If obj cannot be marshaled, Set panics.
-func Set(json []byte, path string, obj interface{}) []byte {
-	return rewritePath(json, path, marshal(obj), false)
+// ValidPath returns an error if path is not syntactically well-formed. A path
+// is ill-formed if it contains an empty accessor (e.g. "foo..bar" or "foo."),
+// an unterminated escape sequence, or an unescaped character reserved for
+// unsupported query syntax, such as wildcards or modifiers. Query accessors
+// of the form "#(field=value)" are well-formed, as are quoted accessors, which
+// may contain any character; but a quoted accessor must be terminated, and
+// must not be followed by anything other than a ".". Note that a
+// well-formed path may still be malformed with respect to a particular
+// document.
+func ValidPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	var off int
+	for {
+		acc, rest, last := splitAccessor(path)
+		if acc == "" {
+			return fmt.Errorf("mjson: empty accessor at offset %v", off)
+		}
+		for i := 0; i < len(acc); i++ {
+			switch acc[i] {
+			case '\\':
+				if i++; i == len(acc) {
+					return fmt.Errorf("mjson: unterminated escape sequence at offset %v", off+i-1)
+				}
+			case '"':
+				if i != 0 {
+					continue
+				} else if j := closingQuote(acc); j == -1 {
+					return fmt.Errorf("mjson: unterminated quoted accessor at offset %v", off)
+				} else if j != len(acc)-1 {
+					return fmt.Errorf("mjson: unexpected character %q after quoted accessor at offset %v", acc[j+1], off+j+1)
+				}
+				i = len(acc) // skip quoted accessor
+			case '#':
+				if _, _, ok := parseQuery(acc); ok && i == 0 {
+					i = len(acc) // skip query
+					continue
+				}
+				return fmt.Errorf("mjson: unsupported character %q at offset %v", acc[i], off+i)
+			case '*', '?', '|', '@':
+				return fmt.Errorf("mjson: unsupported character %q at offset %v", acc[i], off+i)
+			}
+		}
+		if last {
+			return nil
+		}
+		off += len(path) - len(rest)
+		path = rest
+	}
 }
 
-// SetInPlace replaces the value at path in json with obj. If the length of
-// obj is less than the existing value at that path, json will be modified in
-// place. The result may contain extra whitespace. If path is malformed, the
-// original json is returned. If obj cannot be marshaled, SetInPlace panics.
-func SetInPlace(json []byte, path string, obj interface{}) []byte {
-	return rewritePath(json, path, marshal(obj), true)
+// ParsePath returns the accessors of path, in order, with escape sequences
+// decoded and enclosing quotes removed; these are exactly the keys and
+// indices that Get and Set would resolve. Query accessors are returned
+// verbatim. The empty path, which references the root value, has no
+// accessors. If path is not well-formed, ParsePath returns the error reported
+// by ValidPath.
+func ParsePath(path string) ([]string, error) {
+	if err := ValidPath(path); err != nil {
+		return nil, err
+	}
+	return accessors(path), nil
 }
 
-// SetRawInPlace replaces the value at path in json with val. If the length of
-// val is less than the existing value at that path, json will be modified in
-// place. The result may contain extra whitespace. If path is malformed, the
-// original json is returned. If val cannot be marshaled, SetRawInPlace
-// panics.
-func SetRawInPlace(json []byte, path string, val []byte) []byte {
-	return rewritePath(json, path, val, true)
+// accessors returns the decoded accessors of path, or nil if path is empty.
+func accessors(path string) []string {
+	if path == "" {
+		return nil
+	}
+	var accs []string
+	for {
+		acc, rest, last := nextAccessor(path)
+		accs = append(accs, acc)
+		if last {
+			return accs
+		}
+		path = rest
+	}
 }
 
-// rewritePath replaces the value at path in json with val. If inPlace is
-// true, the returned slice may share underlying memory with json. If path is
-// malformed, the original json is returned.
-func rewritePath(json []byte, path string, val []byte, inPlace bool) []byte {
+// nextAccessor splits path into its first accessor and the remainder of the
+// path. If acc is the last accessor in path, last is true. Escape sequences
+// in acc are decoded.
+func nextAccessor(path string) (acc, rest string, last bool) {
+	acc, rest, last = splitAccessor(path)
+	return unescapeAccessor(acc), rest, last
+}
+
+// lastAccessor returns the last accessor in path, with its escape sequences
+// decoded.
+func lastAccessor(path string) string {
+	for {
+		acc, rest, last := nextAccessor(path)
+		if last {
+			return acc
+		}
+		path = rest
+	}
+}
+
+// splitAccessor splits path into its first accessor and the remainder of the
+// path, without decoding escape sequences. A . preceded by a \ or within a
+// query does not separate accessors. If acc is the last accessor in path,
+// last is true.
+func splitAccessor(path string) (acc, rest string, last bool) {
+	var start int
+	if strings.HasPrefix(path, "#(") {
+		// skip to the end of the query
+		if j := strings.IndexByte(path, ')'); j != -1 {
+			start = j + 1
+		}
+	} else if j := closingQuote(path); j != -1 {
+		// skip to the end of the quoted accessor
+		start = j + 1
+	}
+	i := strings.IndexAny(path[start:], ".\\")
+	if i == -1 {
+		// not found; this is the last accessor
+		return path, "", true
+	} else if i += start; path[i] == '.' {
+		return path[:i], path[i+1:], false
+	}
+	// path contains escape sequences; seek to the first unescaped .
+	for ; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			i++ // skip escaped character
+		case '.':
+			return path[:i], path[i+1:], false
+		}
+	}
+	return path, "", true
+}
+
+// closingQuote returns the offset of the unescaped " that closes the quoted
+// accessor at the start of path, or -1 if path does not begin with a quoted
+// accessor.
+func closingQuote(path string) int {
+	if !strings.HasPrefix(path, `"`) {
+		return -1
+	}
+	for j := 1; j < len(path); j++ {
+		switch path[j] {
+		case '\\':
+			j++ // skip escaped character
+		case '"':
+			return j
+		}
+	}
+	return -1
+}
+
+// unescapeAccessor decodes the escape sequences in acc, and removes its
+// enclosing quotes, if any. A \ followed by any character is replaced by that
+// character. A trailing \ is left as-is.
+func unescapeAccessor(acc string) string {
+	if j := closingQuote(acc); j != -1 && j == len(acc)-1 {
+		acc = acc[1:j]
+	}
+	if strings.IndexByte(acc, '\\') == -1 {
+		return acc
+	}
+	buf := make([]byte, 0, len(acc))
+	for i := 0; i < len(acc); i++ {
+		if acc[i] == '\\' && i+1 < len(acc) {
+			i++
+		}
+		buf = append(buf, acc[i])
+	}
+	return string(buf)
+}
+
+// parseQuery parses a query accessor of the form "#(field=value)".
+func parseQuery(acc string) (field, value string, ok bool) {
+	if !strings.HasPrefix(acc, "#(") || !strings.HasSuffix(acc, ")") {
+		return "", "", false
+	}
+	field, value, ok = strings.Cut(acc[2:len(acc)-1], "=")
+	return field, value, ok && field != ""
+}
+
+// queryMatches reports whether the object at the start of json has a field
+// whose value matches value, as described in the package documentation.
+func queryMatches(json []byte, field, value string, opts *Options) bool {
+	i := locateAccessor(json, field, opts)
+	if i == -1 || json[i] == '}' {
+		return false
+	}
+	v := json[i : len(json)-len(consumeValue(json[i:]))]
+	if v[0] == '"' && len(v) >= 2 && unescapeString(v[1:len(v)-1]) == value {
+		return true
+	}
+	return bytes.Equal(appendCompact(nil, v), appendCompact(nil, []byte(value)))
+}
+
+// escapeAccessor escapes each . and \ in key, as well as a leading ", such
+// that the result is a single accessor that references key.
+func escapeAccessor(key string) string {
+	if strings.IndexAny(key, ".\\") == -1 && !strings.HasPrefix(key, `"`) {
+		return key
+	}
+	buf := make([]byte, 0, len(key)+1)
+	for i := 0; i < len(key); i++ {
+		if key[i] == '.' || key[i] == '\\' || (i == 0 && key[i] == '"') {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, key[i])
+	}
+	return string(buf)
+}
+
+// PathToPointer converts path to the equivalent RFC 6901 JSON Pointer.
+func PathToPointer(path string) string {
 	if path == "" {
-		if inPlace {
-			return append(json[:0], val...)
+		return ""
+	}
+	var buf []byte
+	for {
+		acc, rest, last := nextAccessor(path)
+		buf = append(buf, '/')
+		for i := 0; i < len(acc); i++ {
+			switch acc[i] {
+			case '~':
+				buf = append(buf, '~', '0')
+			case '/':
+				buf = append(buf, '~', '1')
+			default:
+				buf = append(buf, acc[i])
+			}
+		}
+		if last {
+			return string(buf)
+		}
+		path = rest
+	}
+}
+
+// PointerToPath converts the RFC 6901 JSON Pointer pointer to the equivalent
+// path, escaping any . or \ characters in its reference tokens. It returns
+// an error if pointer is invalid, or if it cannot be represented as a path
+// (as is the case for any pointer containing an empty reference token, such
+// as "/", which references the empty key of the root object).
+func PointerToPath(pointer string) (string, error) {
+	if pointer == "" {
+		return "", nil
+	} else if pointer[0] != '/' {
+		return "", fmt.Errorf("mjson: JSON Pointer %q does not begin with /", pointer)
+	} else if strings.HasSuffix(pointer, "/") || strings.Contains(pointer, "//") {
+		// paths cannot contain empty keys
+		return "", fmt.Errorf("mjson: JSON Pointer %q cannot be represented as a path", pointer)
+	}
+	var buf []byte
+	for i := 1; i < len(pointer); i++ {
+		switch c := pointer[i]; c {
+		case '/':
+			buf = append(buf, '.')
+		case '~':
+			if i+1 == len(pointer) || (pointer[i+1] != '0' && pointer[i+1] != '1') {
+				return "", fmt.Errorf("mjson: invalid escape sequence in JSON Pointer %q at offset %v", pointer, i)
+			}
+			i++
+			if pointer[i] == '0' {
+				buf = append(buf, '~')
+			} else {
+				buf = append(buf, '/')
+			}
+		case '.', '\\':
+			buf = append(buf, '\\', c)
+		case '"':
+			if pointer[i-1] == '/' {
+				buf = append(buf, '\\') // leading quote
+			}
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
 		}
-		return append([]byte(nil), val...)
 	}
+	return string(buf), nil
+}
 
-	var lastAcc string
+// locatePath returns the offset of the value referenced by path in json,
+// along with the last accessor in path. If path is malformed, locatePath
+// returns -1.
+//
+// If opts.CreatePath is set, locatePath stops at the first accessor that
+// references a special append offset. In that case, the remainder of the path
+// is returned as well, and the value written at the offset must be built via
+// buildPath.
+func locatePath(json []byte, path string, opts *Options) (int, string, string) {
+	create := opts != nil && opts.CreatePath
 	var i int
-	for j := 0; lastAcc == ""; j++ {
-		// determine next accessor by seeking to .
-		dotIndex := strings.IndexByte(path[j:], '.')
-		if dotIndex == -1 {
-			// not found; this is the last accessor
-			dotIndex = len(path[j:])
-			lastAcc = path[j:]
-		}
-		acc := path[j : j+dotIndex]
-		j += dotIndex
-
-		// seek to accessor
-		accIndex := locateAccessor(json[i:], acc)
-		if accIndex == -1 {
-			// not found; return unmodified
-			return json
-		} else if (json[accIndex] == ']' || json[accIndex] == '}' || json[accIndex] == 'l') && lastAcc == "" {
-			// only the last accessor may append
-			return json
+	for {
+		acc, rest, last := nextAccessor(path)
+		if opts != nil && opts.TrimAccessors {
+			acc = strings.TrimSpace(acc)
+		}
+		i = seekAccessor(json, i, acc, last || create, opts)
+		if opts != nil && opts.walk != nil {
+			opts.walk(acc, i != -1 && json[i] != '}' && json[i] != ']' && json[i] != 'l')
+		}
+		if i == -1 {
+			return -1, "", ""
+		} else if last {
+			return i, acc, ""
+		} else if json[i] == '}' || json[i] == ']' || json[i] == 'l' {
+			// the rest of the path does not exist yet
+			return i, acc, rest
+		}
+		path = rest
+	}
+}
+
+// buildPath returns val nested within the objects and arrays referenced by
+// path, which must not exist yet. Object keys are created for each accessor
+// that is not an index; each index must be 0 or -, since the arrays it
+// refers to are empty. If path contains any other index, buildPath returns nil.
+func buildPath(path string, val []byte) []byte {
+	acc, rest, last := nextAccessor(path)
+	if !last {
+		if val = buildPath(rest, val); val == nil {
+			return nil
+		}
+	}
+	if _, err := strconv.Atoi(acc); err == nil || acc == "-" {
+		if acc != "0" && acc != "-" {
+			return nil
+		}
+		newJSON := append(make([]byte, 0, len(val)+2), '[')
+		newJSON = append(newJSON, val...)
+		return append(newJSON, ']')
+	}
+	newJSON := append(make([]byte, 0, len(acc)+len(val)+5), '{')
+	newJSON = appendReplacement(newJSON, '}', false, acc, val) // insert key
+	return append(newJSON, '}')
+}
+
+// locateValue returns the offset of the value referenced by path in json.
+// Unlike locatePath, it returns -1 if path references one of the special
+// append offsets, since no value exists there yet.
+func locateValue(json []byte, path string) int {
+	if path == "" {
+		if i := len(json) - len(consumeWhitespace(json)); i < len(json) {
+			return i
 		}
-		i += accIndex
+		return -1
+	}
+	i, _, _ := locatePath(json, path, nil)
+	if i == -1 || json[i] == '}' || json[i] == ']' || json[i] == 'l' {
+		return -1
+	}
+	return i
+}
+
+// seekAccessor returns the offset of acc within the value at json[i:]. If
+// acc cannot be located, seekAccessor returns -1. Only the last accessor in a
+// path may reference the special append offsets.
+func seekAccessor(json []byte, i int, acc string, last bool, opts *Options) int {
+	accIndex := locateAccessor(json[i:], acc, opts)
+	if accIndex == -1 {
+		return -1
+	}
+	i += accIndex
+	if (json[i] == ']' || json[i] == '}' || json[i] == 'l') && !last {
+		// only the last accessor may append
+		return -1
 	}
+	return i
+}
+
+// rewriteAt replaces the value at offset i in json with val, where i and
+// lastAcc were obtained from locatePath. Unless mode is modeCopy, the
+// returned slice may share underlying memory with json. opts may be nil.
+func rewriteAt(json []byte, i int, lastAcc string, val []byte, mode rewriteMode, opts *Options) []byte {
+	c := json[i]
 	// hack for appending to null
-	appendNull := false
-	if json[i] == 'l' && lastAcc == "0" {
+	if c == 'l' {
 		i -= 3
-		appendNull = true
 	}
+	// if the object or array is not empty, we will need to insert an extra ,
+	comma := (c == '}' && prevChar(json, i) != '{') || (c == ']' && prevChar(json, i) != '[')
 
 	rest := consumeValue(json[i:])
-	if inPlace {
+	oldLen, newLen := len(json[i:])-len(rest), replacementLen(c, comma, lastAcc, val)
+	n := addLen(len(json)-oldLen, newLen)
+	if newLen == -1 || n == -1 || opts.tooLarge(n) {
+		// result is too large; return unmodified
+		return json
+	}
+	if mode != modeCopy {
 		// can we replace without allocating?
-		oldLen, newLen := 0, len(val)
-		if json[i] != '}' && json[i] != ']' {
-			oldLen = len(json[i:]) - len(rest)
-		}
-		if appendNull {
-			newLen += 2 // account for []
-		}
-		if newLen <= oldLen {
+		if newLen <= oldLen && mode == modeShift {
+			// new val is smaller; rewrite in-place and shift the rest of
+			// json to the left
+			appendReplacement(json[:i], c, comma, lastAcc, val)
+			copy(json[i+newLen:], json[i+oldLen:])
+			return json[:n]
+		} else if newLen <= oldLen {
 			// new val is smaller; rewrite in-place
-			if appendNull {
-				json[i] = '['
-				copy(json[i+1:], val)
-				json[i+newLen-1] = ']'
-			} else {
-				copy(json[i:], val)
-			}
+			appendReplacement(json[:i], c, comma, lastAcc, val)
 			i += newLen
 			for j := 0; j < oldLen-newLen; j++ {
 				json[i+j] = ' ' // pad with whitespace
 			}
 			return json
+		} else if n <= cap(json) {
+			// new val is larger, but json has enough spare capacity; shift
+			// the rest of json to the right and rewrite in-place
+			json = json[:n]
+			copy(json[i+newLen:], json[i+oldLen:])
+			appendReplacement(json[:i], c, comma, lastAcc, val)
+			return json
 		}
 	}
 
 	// replace old value
-	newJSON := make([]byte, 0, len(json)+len(val)+len(lastAcc)) // reasonable guess
+	newJSON := make([]byte, 0, n)
 	newJSON = append(newJSON, json[:i]...)
-	switch json[i] {
+	newJSON = appendReplacement(newJSON, c, comma, lastAcc, val)
+	newJSON = append(newJSON, rest...)
+	return newJSON
+}
+
+// replacementLen returns the number of bytes that appendReplacement will
+// append, or -1 if that number would overflow an int.
+func replacementLen(c byte, comma bool, lastAcc string, val []byte) int {
+	n := len(val)
+	switch c {
+	case '}':
+		n = addLen(n, addLen(quotedLen(lastAcc), 1)) // account for "":
+	case 'l':
+		n = addLen(n, 2) // account for []
+	}
+	if comma && n != -1 {
+		n = addLen(n, 1)
+	}
+	return n
+}
+
+// addLen returns a+b, where a and b are non-negative lengths. If a or b is
+// -1, or if the sum would overflow an int, addLen returns -1. This matters on
+// 32-bit platforms, where the length of a very large document may be close
+// to the maximum int.
+func addLen(a, b int) int {
+	if a < 0 || b < 0 || a > maxInt-b {
+		return -1
+	}
+	return a + b
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// appendReplacement appends val to dst, where c is the byte at the offset
+// returned by locatePath. If c is a special append offset, the additional
+// bytes required to insert val are appended as well.
+func appendReplacement(dst []byte, c byte, comma bool, lastAcc string, val []byte) []byte {
+	if comma {
+		dst = append(dst, ',')
+	}
+	switch c {
 	default:
-		newJSON = append(newJSON, val...)
+		dst = append(dst, val...)
 
 	case '}': // insert a new key
-		if prevChar(json, i) != '{' {
-			// if the object is not empty, insert an extra ,
-			newJSON = append(newJSON, ',')
-		}
-		// insert key
-		newJSON = append(newJSON, '"')
-		newJSON = append(newJSON, lastAcc...)
-		newJSON = append(newJSON, '"', ':')
-		newJSON = append(newJSON, val...)
+		dst = AppendEscapedString(dst, lastAcc)
+		dst = append(dst, ':')
+		dst = append(dst, val...)
 
 	case ']': // append to an array
-		if prevChar(json, i) != '[' {
-			// if the array is not empty, insert an extra ,
-			newJSON = append(newJSON, ',')
-		}
-		newJSON = append(newJSON, val...)
+		dst = append(dst, val...)
 
-	case 'n': // replace null with a single-element array
-		newJSON = append(newJSON, '[')
-		newJSON = append(newJSON, val...)
-		newJSON = append(newJSON, ']')
+	case 'l': // replace null with a single-element array
+		dst = append(dst, '[')
+		dst = append(dst, val...)
+		dst = append(dst, ']')
 	}
-	newJSON = append(newJSON, rest...)
-	return newJSON
+	return dst
 }
 
-// locateAccessor returns the offset of acc in json.
-func locateAccessor(json []byte, acc string) int {
+// locateAccessor returns the offset of acc in json. If opts is non-nil, it
+// controls how object keys are compared to acc.
+func locateAccessor(json []byte, acc string, opts *Options) int {
 	origLen := len(json)
 	json = consumeWhitespace(json)
-	if len(json) == 0 || len(json) < len(acc) {
+	if len(json) == 0 {
+		return -1
+	} else if len(json) < len(acc) && (opts == nil || !opts.CreatePath) {
+		// too short to contain acc; but a created path may need to insert a
+		// key into a short object, e.g. {}
 		return -1
 	}
 
@@ -177,50 +3373,96 @@ func locateAccessor(json []byte, acc string) int {
 		return -1
 
 	case '{': // object
-		bacc := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-			Data: (*reflect.StringHeader)(unsafe.Pointer(&acc)).Data,
-			Len:  len(acc),
-			Cap:  len(acc),
-		}))
 		json = consumeSeparator(json) // consume {
 		// iterate through keys, searching for acc
-		for json[0] != '}' {
+		for len(json) > 0 && json[0] != '}' {
 			var key []byte
 			key, json = parseString(json)
 			json = consumeWhitespace(json)
+			if len(json) == 0 {
+				return -1
+			}
 			json = consumeSeparator(json) // consume :
-			if bytes.Equal(key, bacc) {
+			if len(json) == 0 {
+				return -1
+			}
+			if (opts == nil && keyEquals(key, acc)) || (opts != nil && opts.keyMatches(key, acc)) {
 				// acc found
 				return origLen - len(json)
 			}
-			json = consumeValue(json)
+			if json = opts.skipValue(json); json == nil {
+				return -1
+			}
 			json = consumeWhitespace(json)
-			if json[0] == ',' {
+			if len(json) > 0 && json[0] == ',' {
 				json = consumeSeparator(json) // consume ,
 			}
 		}
+		if len(json) == 0 {
+			// unterminated object
+			return -1
+		}
 		// acc not found; return the offset of the closing }
 		return origLen - len(json)
 
 	case '[': // array
+		if acc == "-" {
+			// return the offset of the closing ]
+			_, rest := opts.skipElements(json)
+			if rest == nil {
+				return -1
+			}
+			return origLen - len(rest)
+		}
+		if field, value, ok := parseQuery(acc); ok {
+			json = consumeSeparator(json) // consume [
+			// return the offset of the first matching element
+			for len(json) > 0 && json[0] != ']' {
+				if json[0] == '{' && queryMatches(json, field, value, opts) {
+					return origLen - len(json)
+				}
+				if json = opts.skipValue(json); json == nil {
+					return -1
+				}
+				json = consumeWhitespace(json)
+				if len(json) > 0 && json[0] == ',' {
+					json = consumeSeparator(json) // consume ,
+				}
+			}
+			return -1
+		}
 		// is accessor possibly an array index?
 		n, err := strconv.Atoi(acc)
-		if err != nil || n < 0 {
+		if err != nil {
 			// invalid index
 			return -1
+		} else if n < 0 {
+			// count from the end of the array
+			arrayLen, rest := opts.skipElements(json)
+			if rest == nil {
+				return -1
+			}
+			if n += arrayLen; n < 0 {
+				return -1
+			}
 		}
 		json = consumeSeparator(json) // consume [
 		// consume n keys, stopping early if we hit the end of the array
 		var arrayLen int
-		for n > arrayLen && json[0] != ']' {
-			json = consumeValue(json)
+		for n > arrayLen && len(json) > 0 && json[0] != ']' {
+			if json = opts.skipValue(json); json == nil {
+				return -1
+			}
 			arrayLen++
 			json = consumeWhitespace(json)
-			if json[0] == ',' {
+			if len(json) > 0 && json[0] == ',' {
 				json = consumeSeparator(json) // consume ,
 			}
 		}
-		if n > arrayLen {
+		if len(json) == 0 {
+			// unterminated array
+			return -1
+		} else if n > arrayLen {
 			// Note that n == arrayLen is allowed. In this case, an append
 			// operation is desired; we return the offset of the closing ].
 			return -1
@@ -228,8 +3470,8 @@ func locateAccessor(json []byte, acc string) int {
 		return origLen - len(json)
 
 	case 'n': // null -- interpreted as []
-		// acc must be 0 to append to null
-		if n, err := strconv.Atoi(acc); err != nil || n != 0 {
+		// acc must be 0 or - to append to null
+		if n, err := strconv.Atoi(acc); acc != "-" && (err != nil || n != 0) {
 			return -1
 		}
 		// return the offset of l
@@ -238,20 +3480,226 @@ func locateAccessor(json []byte, acc string) int {
 	}
 }
 
+// forEachMember calls fn with the offsets (relative to json) of each member
+// of the object at the start of json: the start of its key, and the start
+// and end of its value. If fn returns false, iteration stops. Iteration also
+// stops at a truncated member, so callers should reject unterminated objects
+// before relying on every member being visited.
+func forEachMember(json []byte, fn func(keyStart, valStart, valEnd int) bool) {
+	origLen := len(json)
+	json = consumeSeparator(json) // consume {
+	for len(json) > 0 && json[0] != '}' {
+		keyStart := origLen - len(json)
+		_, json = parseString(json)
+		json = consumeWhitespace(json)
+		if len(json) == 0 {
+			return
+		}
+		json = consumeSeparator(json) // consume :
+		if len(json) == 0 {
+			return
+		}
+		valStart := origLen - len(json)
+		if json = consumeValue(json); json == nil {
+			return
+		}
+		if !fn(keyStart, valStart, origLen-len(json)) {
+			return
+		}
+		json = consumeWhitespace(json)
+		if len(json) > 0 && json[0] == ',' {
+			json = consumeSeparator(json) // consume ,
+		}
+	}
+}
+
+// forEachElement calls fn with the start and end offsets (relative to json)
+// of each element of the array at the start of json. If fn returns false,
+// iteration stops, as it does at a truncated element.
+func forEachElement(json []byte, fn func(start, end int) bool) {
+	origLen := len(json)
+	json = consumeSeparator(json) // consume [
+	for len(json) > 0 && json[0] != ']' {
+		start := origLen - len(json)
+		if json = consumeValue(json); json == nil {
+			return
+		}
+		if !fn(start, origLen-len(json)) {
+			return
+		}
+		json = consumeWhitespace(json)
+		if len(json) > 0 && json[0] == ',' {
+			json = consumeSeparator(json) // consume ,
+		}
+	}
+}
+
+// A span holds the start and end offsets of an object member or array
+// element.
+type span struct {
+	start, end int
+}
+
+// removeItems returns splices that remove each item (the members of a single
+// object, or the elements of a single array) for which drop is true. The
+// separators between removed items are removed as well, such that the
+// remaining items are still separated by commas.
+func removeItems(items []span, drop []bool) []splice {
+	var splices []splice
+	for k := 0; k < len(items); k++ {
+		if !drop[k] {
+			continue
+		}
+		// find the end of this run of removed items
+		j := k
+		for j+1 < len(items) && drop[j+1] {
+			j++
+		}
+		switch {
+		case j+1 < len(items):
+			// remove up to the next item
+			splices = append(splices, splice{items[k].start, items[j+1].start, nil})
+		case k > 0:
+			// remove from the end of the previous item
+			splices = append(splices, splice{items[k-1].end, items[j].end, nil})
+		default:
+			// remove every item
+			splices = append(splices, splice{items[k].start, items[j].end, nil})
+		}
+		k = j
+	}
+	return splices
+}
+
+// A splice replaces json[start:end] with val.
+type splice struct {
+	start, end int
+	val        []byte
+}
+
+// applySplices returns a copy of json with each splice applied. The offsets
+// of each splice refer to the original json, so they must be sorted and must
+// not overlap. If splices is empty, the original json is returned.
+func applySplices(json []byte, splices []splice) []byte {
+	if len(splices) == 0 {
+		return json
+	}
+	n := len(json)
+	for _, s := range splices {
+		if n = addLen(n-(s.end-s.start), len(s.val)); n == -1 {
+			return json
+		}
+	}
+	newJSON := make([]byte, 0, n)
+	var prev int
+	for _, s := range splices {
+		newJSON = append(newJSON, json[prev:s.start]...)
+		newJSON = append(newJSON, s.val...)
+		prev = s.end
+	}
+	newJSON = append(newJSON, json[prev:]...)
+	return newJSON
+}
+
+// keyEquals reports whether the object key key, as returned by parseString,
+// is equal to acc once its escape sequences are decoded.
+func keyEquals(key []byte, acc string) bool {
+	if bytes.IndexByte(key, '\\') == -1 {
+		return string(key) == acc
+	}
+	return unescapeString(key) == acc
+}
+
 func parseString(json []byte) ([]byte, []byte) {
 	skip := true
 	for i, c := range json {
 		if c == '"' && !skip {
 			return json[1:i], json[i+1:]
 		}
-		skip = false
-		if c == '\\' {
+		if skip {
+			skip = false
+		} else if c == '\\' {
 			skip = true
 		}
 	}
 	return json, json[len(json):]
 }
 
+// unescapeString returns the contents of the JSON string s (without its
+// quotes), with all escape sequences decoded. Invalid escape sequences are
+// left as-is.
+func unescapeString(s []byte) string {
+	if bytes.IndexByte(s, '\\') == -1 {
+		return string(s)
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf = append(buf, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case '"', '\\', '/':
+			buf = append(buf, s[i])
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'u':
+			r, n := decodeUnicodeEscape(s[i-1:])
+			if n == 0 {
+				buf = append(buf, '\\', 'u')
+				continue
+			}
+			buf = append(buf, string(r)...)
+			i += n - 2
+		default:
+			buf = append(buf, '\\', s[i])
+		}
+	}
+	return string(buf)
+}
+
+// decodeUnicodeEscape decodes the \uXXXX escape sequence at the start of s,
+// combining it with a following escaped low surrogate if necessary. It
+// returns the decoded rune and the number of bytes consumed, which is 0 if s
+// does not begin with a valid escape sequence. Unpaired surrogates decode to
+// utf8.RuneError.
+func decodeUnicodeEscape(s []byte) (rune, int) {
+	r := parseUnicodeEscape(s)
+	if r == -1 {
+		return 0, 0
+	} else if utf16.IsSurrogate(r) {
+		if len(s) >= 12 {
+			if dr := utf16.DecodeRune(r, parseUnicodeEscape(s[6:])); dr != utf8.RuneError {
+				return dr, 12
+			}
+		}
+		return utf8.RuneError, 6
+	}
+	return r, 6
+}
+
+// parseUnicodeEscape returns the code unit of the \uXXXX escape sequence at
+// the start of s, or -1 if s does not begin with a valid escape sequence.
+func parseUnicodeEscape(s []byte) rune {
+	if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+		return -1
+	}
+	r, err := strconv.ParseUint(string(s[2:6]), 16, 16)
+	if err != nil {
+		return -1
+	}
+	return rune(r)
+}
+
 func consumeWhitespace(json []byte) []byte {
 	for i := range json {
 		if c := json[i]; c > ' ' || (c != ' ' && c != '\t' && c != '\n' && c != '\r') {
@@ -305,16 +3753,14 @@ func consumeObject(json []byte) []byte {
 	for n > 0 {
 		// seek to next {, }, or ". Each time we encounter a {, increment n. Each
 		// time encounter a }, decrement n. Exit when n == 0. If we encounter ",
-		// consume the string.
-		var c byte
-		for i := range json {
-			if c = json[i]; c == '{' || c == '}' || c == '"' {
-				json = json[i:]
-				break
-			}
+		// consume the string. If the object is unterminated, return nil.
+		i := bytes.IndexAny(json, `{}"`)
+		if i == -1 {
+			return nil
 		}
+		json = json[i:]
 
-		switch c {
+		switch json[0] {
 		case '{':
 			n++
 			json = json[1:] // consume {
@@ -322,18 +3768,11 @@ func consumeObject(json []byte) []byte {
 			n--
 			json = json[1:] // consume }
 		case '"':
-			// consume string
-			skip := true
-			for i, c := range json {
-				if c == '"' && !skip {
-					json = json[i+1:]
-					break
-				}
-				skip = false
-				if c == '\\' {
-					skip = true
-				}
+			rest := consumeString(json)
+			if len(rest) == len(json) {
+				return nil
 			}
+			json = rest
 		}
 	}
 	return json
@@ -345,16 +3784,14 @@ func consumeArray(json []byte) []byte {
 	for n > 0 {
 		// seek to next [, ], or ". Each time we encounter a [, increment n. Each
 		// time encounter a ], decrement n. Exit when n == 0. If we encounter ",
-		// consume the string.
-		var c byte
-		for i := range json {
-			if c = json[i]; c == '[' || c == ']' || c == '"' {
-				json = json[i:]
-				break
-			}
+		// consume the string. If the array is unterminated, return nil.
+		i := bytes.IndexAny(json, `[]"`)
+		if i == -1 {
+			return nil
 		}
+		json = json[i:]
 
-		switch c {
+		switch json[0] {
 		case '[':
 			n++
 			json = json[1:] // consume [
@@ -362,18 +3799,11 @@ func consumeArray(json []byte) []byte {
 			n--
 			json = json[1:] // consume ]
 		case '"':
-			// consume string
-			skip := true
-			for i, c := range json {
-				if c == '"' && !skip {
-					json = json[i+1:]
-					break
-				}
-				skip = false
-				if c == '\\' {
-					skip = true
-				}
+			rest := consumeString(json)
+			if len(rest) == len(json) {
+				return nil
 			}
+			json = rest
 		}
 	}
 	return json
@@ -385,8 +3815,9 @@ func consumeString(json []byte) []byte {
 		if c == '"' && !skip {
 			return json[i+1:]
 		}
-		skip = false
-		if c == '\\' {
+		if skip {
+			skip = false
+		} else if c == '\\' {
 			skip = true
 		}
 	}
@@ -406,10 +3837,95 @@ func consumeNumber(json []byte) []byte {
 	return json[len(json):]
 }
 
+// AppendEscapedString appends the JSON encoding of s, including its quotes,
+// to dst and returns the extended slice. This is the same encoding used by
+// the Set functions for string values. ", \, and control characters are
+// escaped, using the short forms (e.g. \n) where available. U+2028 and
+// U+2029 are escaped as well, and invalid UTF-8 is replaced with U+FFFD. HTML
+// characters are not escaped.
+func AppendEscapedString(dst []byte, s string) []byte {
+	return appendEscapedString(dst, s, false)
+}
+
+// EscapeForString returns json escaped as the contents of a JSON string,
+// without the enclosing quotes, so that json can be embedded as a string
+// value. The escaping is that of AppendEscapedString.
+func EscapeForString(json []byte) []byte {
+	s := appendEscapedString(make([]byte, 0, len(json)+2), string(json), false)
+	return s[1 : len(s)-1]
+}
+
+// quotedLen returns the number of bytes that AppendEscapedString will append
+// for s.
+func quotedLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c == '"' || c == '\\' || c >= utf8.RuneSelf {
+			return len(AppendEscapedString(nil, s))
+		}
+	}
+	return len(s) + 2
+}
+
+// appendEscapedString is AppendEscapedString, optionally also escaping <, >,
+// and & as encoding/json does.
+func appendEscapedString(dst []byte, s string, escapeHTML bool) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= ' ' && c != '"' && c != '\\' && !(escapeHTML && (c == '<' || c == '>' || c == '&')) {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+		} else if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[r&0xF])
+		} else {
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
+
 // marshal marshals obj as JSON. If obj has a MarshalJSON method, it is called
 // directly. Note that this may produce invalid JSON. If obj cannot be
 // marshaled, marshal panics.
 func marshal(obj interface{}) []byte {
+	return marshalOpts(obj, nil)
+}
+
+// marshalOpts is marshal, encoding according to opts. opts may be nil.
+func marshalOpts(obj interface{}, opts *Options) []byte {
 	if m, ok := obj.(gojson.Marshaler); ok {
 		b, err := m.MarshalJSON()
 		if err != nil {
@@ -420,11 +3936,13 @@ func marshal(obj interface{}) []byte {
 
 	switch v := obj.(type) {
 	default:
-		b, err := gojson.Marshal(obj)
-		if err != nil {
+		var buf bytes.Buffer
+		enc := gojson.NewEncoder(&buf)
+		enc.SetEscapeHTML(opts != nil && opts.EscapeHTML)
+		if err := enc.Encode(obj); err != nil {
 			panic(err)
 		}
-		return b
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
 
 	case int:
 		return strconv.AppendInt(nil, int64(v), 10)
@@ -451,7 +3969,7 @@ func marshal(obj interface{}) []byte {
 	case float64:
 		return strconv.AppendFloat(nil, float64(v), 'f', -1, 64)
 	case string:
-		return strconv.AppendQuote(nil, v)
+		return appendEscapedString(nil, v, opts != nil && opts.EscapeHTML)
 	case bool:
 		if v {
 			return []byte("true")
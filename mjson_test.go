@@ -2,7 +2,15 @@ package mjson
 
 import (
 	"bytes"
+	"context"
+	gojson "encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/tidwall/sjson"
 )
@@ -22,6 +30,7 @@ func TestSet(t *testing.T) {
 		{`{"foo": {"bar": "baz"}}`, `foo.bar`, false, `{"foo": {"bar": false}}`},
 		{`{"foo":"bar"}`, `bar`, "baz", `{"foo":"bar","bar":"baz"}`},
 		{`{"foo": {}}`, `foo.bar`, 3, `{"foo": {"bar":3}}`},
+		{`{"foo": null}`, `foo`, 3, `{"foo": 3}`},
 		// array
 		{`[]`, `foo`, "bar", `[]`},
 		{`[1]`, `0`, "bar", `["bar"]`},
@@ -48,6 +57,12 @@ func TestSet(t *testing.T) {
 		{`{"foo": null}`, `foo.0`, "bar", `{"foo": ["bar"]}`},
 		// monster
 		{`{"foo": [{}, {"bar": [{"baz":""}]}}]`, `foo.1.bar.0.baz`, "quux", `{"foo": [{}, {"bar": [{"baz":"quux"}]}}]`},
+		// unterminated
+		{`{`, `foo`, 1, `{`},
+		{`[`, `10`, 1, `[`},
+		{`{"a":1`, `abcdefgh`, 1, `{"a":1`},
+		{`{"a":1`, `b`, 1, `{"a":1`},
+		{`[1,2`, `5`, 1, `[1,2`},
 	}
 	for _, test := range tests {
 		if res := Set([]byte(test.json), test.path, test.val); string(res) != test.exp {
@@ -56,6 +71,722 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestSetComputed(t *testing.T) {
+	json := []byte(`{"price":3,"qty":4}`)
+	total := func(doc []byte) interface{} {
+		price, _ := strconv.Atoi(string(Get(doc, "price")))
+		qty, _ := strconv.Atoi(string(Get(doc, "qty")))
+		return price * qty
+	}
+	exp := `{"price":3,"qty":4,"total":12}`
+	if res := SetComputed(json, "total", total); string(res) != exp {
+		t.Errorf("SetComputed: expected '%s', got '%s'", exp, res)
+	}
+	if res := SetComputed(json, "foo.total", total); string(res) != string(json) {
+		t.Errorf("SetComputed: expected '%s', got '%s'", json, res)
+	}
+}
+
+func TestSetOpts(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		opts *Options
+		val  interface{}
+		exp  string
+	}{
+		{`{"Foo":{"BAR":1}}`, `foo.bar`, nil, 2, `{"Foo":{"BAR":1}}`},
+		{`{"Foo":{"BAR":1}}`, `foo.bar`, &Options{}, 2, `{"Foo":{"BAR":1}}`},
+		{`{"Foo":{"BAR":1}}`, `foo.bar`, &Options{CaseInsensitive: true}, 2, `{"Foo":{"BAR":2}}`},
+		{`{" foo ":1}`, `foo`, &Options{TrimAccessors: true}, 2, `{" foo ":2}`},
+		{`{"foo":1}`, ` foo `, &Options{TrimAccessors: true}, 2, `{"foo":2}`},
+		{`{"foo":[1]}`, ` foo . 0 `, &Options{TrimAccessors: true}, 2, `{"foo":[2]}`},
+		{`{" Foo ":{"Bar ":1}}`, `foo. bar`, &Options{CaseInsensitive: true, TrimAccessors: true}, 2, `{" Foo ":{"Bar ":2}}`},
+		{`{" Foo ":{"Bar ":1}}`, `foo. bar`, &Options{CaseInsensitive: true}, 2, `{" Foo ":{"Bar ":1}}`},
+		{`{"café":1}`, `cafe`, &Options{NormalizeUnicode: true}, 2, `{"café":2}`},
+		{`{"caf\u00e9":1}`, `café`, &Options{NormalizeUnicode: true}, 2, `{"caf\u00e9":2}`},
+		{`{"Café":1}`, `CAFÉ`, &Options{NormalizeUnicode: true, CaseInsensitive: true}, 2, `{"Café":2}`},
+		{`{"café":1}`, `cafe`, &Options{CaseInsensitive: true}, 2, `{"café":1,"cafe":2}`},
+		{`{"\u0061":1}`, `a`, &Options{}, 2, `{"\u0061":2}`},
+		{`{"\u0041":1}`, `a`, &Options{CaseInsensitive: true}, 2, `{"\u0041":2}`},
+		{`{" \u0061 ":1}`, `a`, &Options{TrimAccessors: true}, 2, `{" \u0061 ":2}`},
+		{`{"\u0061":{}}`, `a.b`, &Options{CreatePath: true}, 2, `{"\u0061":{"b":2}}`},
+		// created paths
+		{``, `a.b`, nil, 1, ``},
+		{``, `a.b`, &Options{CreatePath: true}, 1, `{"a":{"b":1}}`},
+		{" \n", `a`, &Options{CreatePath: true}, 1, `{"a":1}`},
+		{``, `0.a`, &Options{CreatePath: true}, 1, `[{"a":1}]`},
+		{``, `1`, &Options{CreatePath: true}, 1, ``},
+		{`{"a":{}}`, `a.b.c`, &Options{CreatePath: true}, 1, `{"a":{"b":{"c":1}}}`},
+		{`{"a":{"b":2}}`, `a.c.0`, &Options{CreatePath: true}, 1, `{"a":{"b":2,"c":[1]}}`},
+		{`{"a":{"b":2}}`, `a.c.1`, &Options{CreatePath: true}, 1, `{"a":{"b":2}}`},
+		{`{"a":[]}`, `a.0.b`, &Options{CreatePath: true}, 1, `{"a":[{"b":1}]}`},
+		{`{"a":[2]}`, `a.2.b`, &Options{CreatePath: true}, 1, `{"a":[2]}`},
+		{`{"a":null}`, `a.0.0`, &Options{CreatePath: true}, 1, `{"a":[[1]]}`},
+		{`{"a":1}`, `a.b`, &Options{CreatePath: true}, 1, `{"a":1}`},
+		{`{"a":{"b":2}}`, `a.b`, &Options{CreatePath: true}, 1, `{"a":{"b":1}}`},
+		// size limit
+		{`{"a":1}`, `a`, &Options{MaxResultSize: 7}, 2, `{"a":2}`},
+		{`{"a":1}`, `a`, &Options{MaxResultSize: 7}, 10, `{"a":1}`},
+		{`{"a":1}`, `b`, &Options{MaxResultSize: 13}, 2, `{"a":1,"b":2}`},
+		{`{"a":1}`, `b`, &Options{MaxResultSize: 12}, 2, `{"a":1}`},
+		{`{"a":1}`, ``, &Options{MaxResultSize: 3}, "foo", `{"a":1}`},
+		{``, `a.b`, &Options{MaxResultSize: 12, CreatePath: true}, 1, ``},
+		{`{"a":1}`, `a`, &Options{MaxResultSize: 0}, "no limit", `{"a":"no limit"}`},
+		// HTML escaping
+		{`{"a":1}`, `a`, nil, "<b>", `{"a":"<b>"}`},
+		{`{"a":1}`, `a`, &Options{}, "<b>", `{"a":"<b>"}`},
+		{`{"a":1}`, `a`, &Options{EscapeHTML: true}, "<b>&", `{"a":"\u003cb\u003e\u0026"}`},
+		{`{"a":1}`, `a`, nil, []string{"<b>"}, `{"a":["<b>"]}`},
+		{`{"a":1}`, `a`, &Options{}, []string{"<b>"}, `{"a":["<b>"]}`},
+		{`{"a":1}`, `a`, &Options{EscapeHTML: true}, []string{"<b>"}, `{"a":["\u003cb\u003e"]}`},
+		// nested arrays
+		{`{}`, `matrix.0.0`, &Options{CreatePath: true}, 5, `{"matrix":[[5]]}`},
+		{`{}`, `matrix.0.0`, nil, 5, `{}`},
+		{`{}`, `matrix.0.1`, &Options{CreatePath: true}, 5, `{}`},
+		{`{`, `foo`, &Options{CreatePath: true}, 5, `{`},
+		{`{"a":1`, `abcdefgh`, &Options{CreatePath: true}, 5, `{"a":1`},
+		{`[`, `10`, &Options{CreatePath: true}, 5, `[`},
+		{`{}`, `a.-.-`, &Options{CreatePath: true}, 5, `{"a":[[5]]}`},
+		{`{"a":[[1]]}`, `a.-1.-`, &Options{CreatePath: true}, 5, `{"a":[[1,5]]}`},
+		// duplicate keys
+		{`{"a":1,"a":2}`, `a`, nil, 3, `{"a":3,"a":2}`},
+		{`{"a":1,"a":2}`, `a`, &Options{DedupeOnSet: true}, 3, `{"a":3}`},
+		{`{"a":1, "b":2, "a":3, "c":4, "a":5}`, `a`, &Options{DedupeOnSet: true}, 0, `{"a":0, "b":2, "c":4}`},
+		{`{"b":2,"a":1,"a":3}`, `a`, &Options{DedupeOnSet: true}, 0, `{"b":2,"a":0}`},
+		{`{"x":{"a":1,"a":2},"a":3}`, `x.a`, &Options{DedupeOnSet: true}, 0, `{"x":{"a":0},"a":3}`},
+		{`{"A":1,"a":2}`, `a`, &Options{DedupeOnSet: true, CaseInsensitive: true}, 0, `{"A":0}`},
+		{`{"a":1}`, `b`, &Options{DedupeOnSet: true}, 0, `{"a":1,"b":0}`},
+		{`[{"a":1,"a":2}]`, `0.a`, &Options{DedupeOnSet: true}, 0, `[{"a":0}]`},
+	}
+	for _, test := range tests {
+		if res := SetOpts([]byte(test.json), test.path, test.val, test.opts); string(res) != test.exp {
+			t.Errorf("SetOpts('%s', %q, %+v, '%v'): expected '%s', got '%s'", test.json, test.path, test.opts, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestUpsertReport(t *testing.T) {
+	tests := []struct {
+		json    string
+		path    string
+		exp     string
+		created []string
+	}{
+		{`{"a":{"b":{}}}`, "a.b.c.d.e", `{"a":{"b":{"c":{"d":{"e":1}}}}}`, []string{"c", "d", "e"}},
+		{`{"a":{"b":{"x":0}}}`, "a.b.c", `{"a":{"b":{"x":0,"c":1}}}`, []string{"c"}},
+		{`{"a":{"b":2}}`, "a.b", `{"a":{"b":1}}`, nil},
+		{`{"a":[]}`, "a.0.b\\.c", `{"a":[{"b.c":1}]}`, []string{"0", "b.c"}},
+		{`{"a":null}`, "a.0", `{"a":[1]}`, []string{"0"}},
+		{``, "a.b", `{"a":{"b":1}}`, []string{"a", "b"}},
+		{`{"a":{}}`, "a.b.1", `{"a":{}}`, nil},
+		{`{"a":1}`, "a.b", `{"a":1}`, nil},
+	}
+	for _, test := range tests {
+		res, created := UpsertReport([]byte(test.json), test.path, 1)
+		if string(res) != test.exp {
+			t.Errorf("UpsertReport(%q, %q): expected %q, got %q", test.json, test.path, test.exp, res)
+		}
+		if strings.Join(created, "|") != strings.Join(test.created, "|") || len(created) != len(test.created) {
+			t.Errorf("UpsertReport(%q, %q): expected created %q, got %q", test.json, test.path, test.created, created)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	tests := []struct {
+		json      string
+		overrides map[string]interface{}
+		exp       string
+	}{
+		{`{"a":1}`, nil, `{"a":1}`},
+		{`{"a":1,"b":{"c":2}}`, map[string]interface{}{"a": 3, "b.c": 4}, `{"a":3,"b":{"c":4}}`},
+		{`{"a":1}`, map[string]interface{}{"b.c.d": 2, "a": 3}, `{"a":3,"b":{"c":{"d":2}}}`},
+		{`{"a":1}`, map[string]interface{}{"b.c": 2, "b": map[string]int{}}, `{"a":1,"b":{"c":2}}`},
+		{`{"a":1}`, map[string]interface{}{"b": 2, "c": 3}, `{"a":1,"b":2,"c":3}`},
+		{`{"a":1}`, map[string]interface{}{"a": nil}, `{"a":null}`},
+		{`{"a":[1]}`, map[string]interface{}{"a.1": 2, "a.5": 3, "x": 4}, `{"a":[1,2],"x":4}`},
+		{``, map[string]interface{}{"a.b": 1}, `{"a":{"b":1}}`},
+	}
+	for _, test := range tests {
+		if res := Override([]byte(test.json), test.overrides); string(res) != test.exp {
+			t.Errorf("Override('%s', %v): expected '%s', got '%s'", test.json, test.overrides, test.exp, res)
+		}
+	}
+}
+
+func TestCreateMatrix(t *testing.T) {
+	json := []byte(`{}`)
+	opts := &Options{CreatePath: true}
+	for _, path := range []string{"matrix.0.0", "matrix.0.1", "matrix.1.0", "matrix.1.1"} {
+		json = SetOpts(json, path, path[len(path)-3:], opts)
+	}
+	if exp := `{"matrix":[["0.0","0.1"],["1.0","1.1"]]}`; string(json) != exp {
+		t.Errorf("expected '%s', got '%s'", exp, json)
+	}
+	// skipping a row or column is malformed
+	for _, path := range []string{"matrix.0.3", "matrix.3.0"} {
+		if res := SetOpts(json, path, 0, opts); string(res) != string(json) {
+			t.Errorf("SetOpts(%q): expected no-op, got '%s'", path, res)
+		}
+	}
+}
+
+func TestSetWithWalkHook(t *testing.T) {
+	type call struct {
+		acc   string
+		found bool
+	}
+	tests := []struct {
+		json  string
+		path  string
+		calls []call
+		exp   string
+	}{
+		{`{"a":{"b":[1]}}`, `a.b.0`, []call{{"a", true}, {"b", true}, {"0", true}}, `{"a":{"b":[2]}}`},
+		{`{"a":{"b":[1]}}`, `a.b.1`, []call{{"a", true}, {"b", true}, {"1", false}}, `{"a":{"b":[1,2]}}`},
+		{`{"a":{"b":[1]}}`, `a.c`, []call{{"a", true}, {"c", false}}, `{"a":{"b":[1],"c":2}}`},
+		{`{"a":{"b":[1]}}`, `a.c.d`, []call{{"a", true}, {"c", false}}, `{"a":{"b":[1]}}`},
+		{`{"a":{"b":[1]}}`, `x.b.0`, []call{{"x", false}}, `{"a":{"b":[1]}}`},
+		{`{"a":{"b":[1]}}`, `a.b.5`, []call{{"a", true}, {"b", true}, {"5", false}}, `{"a":{"b":[1]}}`},
+		{`{"a.b":1}`, `a\.b`, []call{{"a.b", true}}, `{"a.b":2}`},
+		{`{"a":1}`, ``, nil, `2`},
+	}
+	for _, test := range tests {
+		var calls []call
+		res := SetWithWalkHook([]byte(test.json), test.path, 2, func(acc string, found bool) {
+			calls = append(calls, call{acc, found})
+		})
+		if string(res) != test.exp {
+			t.Errorf("SetWithWalkHook('%s', %q): expected '%s', got '%s'", test.json, test.path, test.exp, res)
+		}
+		if len(calls) != len(test.calls) {
+			t.Errorf("SetWithWalkHook('%s', %q): expected calls %v, got %v", test.json, test.path, test.calls, calls)
+			continue
+		}
+		for i := range calls {
+			if calls[i] != test.calls[i] {
+				t.Errorf("SetWithWalkHook('%s', %q): expected calls %v, got %v", test.json, test.path, test.calls, calls)
+				break
+			}
+		}
+	}
+}
+
+func TestSetFloatFmt(t *testing.T) {
+	tests := []struct {
+		json   string
+		val    float64
+		format byte
+		prec   int
+		exp    string
+	}{
+		{`{"a":1}`, 2.5, 'f', 2, `{"a":2.50}`},
+		{`{"a":1}`, 2.005, 'f', 0, `{"a":2}`},
+		{`{"a":1}`, -1234.5, 'e', 3, `{"a":-1.234e+03}`},
+		{`{"a":1}`, 0.000001, 'g', -1, `{"a":1e-06}`},
+		{`{"a":1}`, 2.5, 'b', -1, `{"a":1}`},
+		{`{"a":1}`, 2.5, 'x', -1, `{"a":1}`},
+		{`{"a":1}`, math.NaN(), 'f', 2, `{"a":1}`},
+		{`{"a":1}`, math.Inf(-1), 'f', 2, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if res := SetFloatFmt([]byte(test.json), "a", test.val, test.format, test.prec); string(res) != test.exp {
+			t.Errorf("SetFloatFmt('%s', %v, %q, %v): expected '%s', got '%s'", test.json, test.val, test.format, test.prec, test.exp, res)
+		}
+	}
+}
+
+func TestSetNumberAsString(t *testing.T) {
+	tests := []struct {
+		val string
+		exp string
+	}{
+		{`123.45`, `{"a":"123.45"}`},
+		{`-0.5`, `{"a":"-0.5"}`},
+		{`1e-300`, `{"a":"1e-300"}`},
+		{`12345678901234567890123`, `{"a":"12345678901234567890123"}`},
+		{`abc`, `{"a":1}`},
+		{`1.`, `{"a":1}`},
+		{`01`, `{"a":1}`},
+		{`1 `, `{"a":1}`},
+		{`"1"`, `{"a":1}`},
+		{``, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if res := SetNumberAsString([]byte(`{"a":1}`), "a", test.val); string(res) != test.exp {
+			t.Errorf("SetNumberAsString(%q): expected %q, got %q", test.val, test.exp, res)
+		}
+	}
+}
+
+func TestSetFirst(t *testing.T) {
+	tests := []struct {
+		json  string
+		paths []string
+		exp   string
+	}{
+		{`{"oldName":1}`, []string{"newName", "oldName"}, `{"oldName":2}`},
+		{`{"oldName":1,"newName":1}`, []string{"newName", "oldName"}, `{"oldName":1,"newName":2}`},
+		{`{"a":{"b":null}}`, []string{"a.c", "a.b"}, `{"a":{"b":2}}`},
+		{`{"a":[0]}`, []string{"a.1", "a.-", "a.0"}, `{"a":[2]}`},
+		{`{"a":1}`, []string{"b", "c"}, `{"a":1}`},
+		{`{"a":1}`, nil, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if res := SetFirst([]byte(test.json), test.paths, 2); string(res) != test.exp {
+			t.Errorf("SetFirst(%q, %q): expected %q, got %q", test.json, test.paths, test.exp, res)
+		}
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{`{"a":1,"b":{"c":2},"d":3}`, "b", `{"a":1,"b":null,"d":3}`},
+		{`{"a":[1,2,3]}`, "a.1", `{"a":[1,null,3]}`},
+		{`{"a":[1,2,3]}`, "a.-1", `{"a":[1,2,null]}`},
+		{`{"a":1}`, "b", `{"a":1}`},
+		{`{"a":[1]}`, "a.1", `{"a":[1]}`},
+		{`{"a":[1]}`, "a.-", `{"a":[1]}`},
+	}
+	for _, test := range tests {
+		if res := SoftDelete([]byte(test.json), test.path); string(res) != test.exp {
+			t.Errorf("SoftDelete(%q, %q): expected %q, got %q", test.json, test.path, test.exp, res)
+		}
+	}
+
+	json := `{"a":1,"b":[2,3]}`
+	tomb := []byte(`{"__deleted":true}`)
+	if res := SoftDeleteWith([]byte(json), "b.0", tomb); string(res) != `{"a":1,"b":[{"__deleted":true},3]}` {
+		t.Errorf("SoftDeleteWith: got %q", res)
+	}
+	if res := SoftDeleteWith([]byte(json), "c", tomb); string(res) != json {
+		t.Errorf("SoftDeleteWith: got %q", res)
+	}
+}
+
+func TestSetSparse(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{`{"a":["a","b"]}`, "a.4", `{"a":["a","b",null,null,"v"]}`},
+		{`{"a":["a","b"]}`, "a.3", `{"a":["a","b",null,"v"]}`},
+		{`{"a":["a","b"]}`, "a.2", `{"a":["a","b","v"]}`},
+		{`{"a":["a","b"]}`, "a.0", `{"a":["v","b"]}`},
+		{`{"a":["a","b"]}`, "a.-1", `{"a":["a","v"]}`},
+		{`{"a":[]}`, "a.2", `{"a":[null,null,"v"]}`},
+		{`[[1]]`, "0.2", `[[1,null,"v"]]`},
+		{`{"a":{}}`, "a.2", `{"a":{"2":"v"}}`},
+		{`{"a":[]}`, "a.2.b", `{"a":[]}`},
+		// huge indices
+		{`[1,2]`, "9223372036854775807", `[1,2]`},
+		{`[1,2]`, "1000000000000", `[1,2]`},
+		{`{"a":[1,2]}`, "a.100000000", `{"a":[1,2]}`},
+	}
+	for _, test := range tests {
+		if res := SetSparse([]byte(test.json), test.path, "v"); string(res) != test.exp {
+			t.Errorf("SetSparse(%q, %q): expected %q, got %q", test.json, test.path, test.exp, res)
+		}
+	}
+	// the default remains strict
+	if res := Set([]byte(`["a","b"]`), "4", "v"); string(res) != `["a","b"]` {
+		t.Errorf("Set: expected out-of-range index to be ignored, got %q", res)
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	src := []byte(`{"user":{"name":"x","tags":["a"]},"n":7}`)
+	tests := []struct {
+		dst     string
+		dstPath string
+		srcPath string
+		exp     string
+	}{
+		{`{"owner":null}`, "owner", "user", `{"owner":{"name":"x","tags":["a"]}}`},
+		{`{"owner":{"id":1}}`, "owner.tags", "user.tags", `{"owner":{"id":1,"tags":["a"]}}`},
+		{`{"ns":[1,2]}`, "ns.-", "n", `{"ns":[1,2,7]}`},
+		{`{"ns":[1,2]}`, "ns.0", "user.name", `{"ns":["x",2]}`},
+		{`{"ns":[1,2]}`, "ns.-", "missing", `{"ns":[1,2]}`},
+		{`{"ns":[1,2]}`, "x.y", "n", `{"ns":[1,2]}`},
+	}
+	for _, test := range tests {
+		if res := CopyFrom([]byte(test.dst), test.dstPath, src, test.srcPath); string(res) != test.exp {
+			t.Errorf("CopyFrom(%q, %q, %q): expected %q, got %q", test.dst, test.dstPath, test.srcPath, test.exp, res)
+		}
+	}
+}
+
+func TestSetFloatExact(t *testing.T) {
+	tests := []struct {
+		val          float64
+		forceDecimal bool
+		exp          string
+	}{
+		{5.0, false, `{"a":5}`},
+		{5.0, true, `{"a":5.0}`},
+		{-3, true, `{"a":-3.0}`},
+		{0, true, `{"a":0.0}`},
+		{5.25, false, `{"a":5.25}`},
+		{5.25, true, `{"a":5.25}`},
+		{1e21, true, `{"a":1000000000000000000000.0}`},
+		{1e-7, true, `{"a":0.0000001}`},
+		{math.NaN(), true, `{"a":1}`},
+		{math.Inf(-1), false, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if res := SetFloatExact([]byte(`{"a":1}`), "a", test.val, test.forceDecimal); string(res) != test.exp {
+			t.Errorf("SetFloatExact(%v, %v): expected %q, got %q", test.val, test.forceDecimal, test.exp, res)
+		}
+	}
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalJSON() ([]byte, error) { return nil, errors.New("no") }
+
+func TestSetSafe(t *testing.T) {
+	json := []byte(`{"a":1}`)
+	if res, err := SetSafe(json, "a", "x"); err != nil || string(res) != `{"a":"x"}` {
+		t.Errorf("SetSafe: expected success, got %q (%v)", res, err)
+	}
+	if res, err := SetSafe(json, "b.c", "x"); err != nil || string(res) != `{"a":1}` {
+		t.Errorf("SetSafe: expected original json for malformed path, got %q (%v)", res, err)
+	}
+	for _, obj := range []interface{}{make(chan int), func() {}, math.Inf(1), failingMarshaler{}} {
+		res, err := SetSafe(json, "a", obj)
+		if err == nil {
+			t.Errorf("SetSafe(%T): expected error", obj)
+		} else if string(res) != `{"a":1}` {
+			t.Errorf("SetSafe(%T): expected original json, got %q", obj, res)
+		}
+	}
+	var uerr *gojson.UnsupportedTypeError
+	if _, err := SetSafe(json, "a", make(chan int)); !errors.As(err, &uerr) {
+		t.Errorf("SetSafe: expected wrapped UnsupportedTypeError, got %v", err)
+	}
+}
+
+func TestSetQuiet(t *testing.T) {
+	tests := []struct {
+		json    string
+		path    string
+		val     interface{}
+		exp     string
+		aliases bool
+	}{
+		{`{"a":1}`, `a`, 1, `{"a":1}`, true},
+		{`{"a":[1, 2]}`, `a`, []int{1, 2}, `{"a":[1, 2]}`, true},
+		{`{"a":"x"}`, `a`, "x", `{"a":"x"}`, true},
+		{` {"a":1} `, ``, map[string]int{"a": 1}, ` {"a":1} `, true},
+		{`{"a":1}`, `a`, 2, `{"a":2}`, false},
+		{`{"a":1}`, `b`, 1, `{"a":1,"b":1}`, false},
+		{`{"a":null}`, `a.0`, 1, `{"a":[1]}`, false},
+		{`{"a":[1]}`, `a.1`, 1, `{"a":[1,1]}`, false},
+		{`{"a":"1"}`, `a`, 1, `{"a":1}`, false},
+	}
+	for _, test := range tests {
+		json := []byte(test.json)
+		res := SetQuiet(json, test.path, test.val)
+		if string(res) != test.exp {
+			t.Errorf("SetQuiet('%s', %q, '%v'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		} else if aliases := &res[0] == &json[0]; aliases != test.aliases {
+			t.Errorf("SetQuiet('%s', %q, '%v'): expected aliasing %v, got %v", test.json, test.path, test.val, test.aliases, aliases)
+		}
+	}
+}
+
+func TestNegativeIndex(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		val  interface{}
+		exp  string
+	}{
+		{`{"foo":{"bars":[{"baz":1},{"baz":2}]}}`, `foo.bars.-1.baz`, 3, `{"foo":{"bars":[{"baz":1},{"baz":3}]}}`},
+		{`{"foo":{"bars":[{"baz":1},{"baz":2}]}}`, `foo.bars.-2.baz`, 3, `{"foo":{"bars":[{"baz":3},{"baz":2}]}}`},
+		{`{"foo":{"bars":[{"baz":1},{"baz":2}]}}`, `foo.bars.-1.qux`, 3, `{"foo":{"bars":[{"baz":1},{"baz":2,"qux":3}]}}`},
+		{`{"foo":{"bars":[[1,2],[3,4]]}}`, `foo.bars.-1.-1`, 5, `{"foo":{"bars":[[1,2],[3,5]]}}`},
+		{`{"foo":[1,2]}`, `foo.-1`, 3, `{"foo":[1,3]}`},
+		{`{"foo":{"bars":[{"baz":1}]}}`, `foo.bars.-2.baz`, 3, `{"foo":{"bars":[{"baz":1}]}}`},
+		{`{"foo":[]}`, `foo.-1`, 3, `{"foo":[]}`},
+		{`{"foo":null}`, `foo.-1`, 3, `{"foo":null}`},
+		{`[1,2`, `-1`, 9, `[1,2`},
+		{`{"foo":[1,2`, `foo.-1`, 9, `{"foo":[1,2`},
+		// append
+		{`{"foo":[1,2]}`, `foo.-`, 3, `{"foo":[1,2,3]}`},
+		{`{"foo":[]}`, `foo.-`, 3, `{"foo":[3]}`},
+		{`{"foo":null}`, `foo.-`, 3, `{"foo":[3]}`},
+		{`{"foo":[{"a":1}]}`, `foo.-.a`, 3, `{"foo":[{"a":1}]}`},
+		{`{"foo":{"-":1}}`, `foo.-`, 3, `{"foo":{"-":3}}`},
+	}
+	for _, test := range tests {
+		if res := Set([]byte(test.json), test.path, test.val); string(res) != test.exp {
+			t.Errorf("Set('%s', %q, '%v'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		}
+	}
+
+	// -1 overwrites the last element, while - appends
+	json := Set([]byte(`[1,2]`), "-1", 3)
+	json = Set(json, "-", 4)
+	if string(json) != `[1,3,4]` {
+		t.Errorf("expected '[1,3,4]', got '%s'", json)
+	}
+}
+
+func TestSetKeyChecked(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		val  interface{}
+		exp  string
+		err  bool
+	}{
+		{`{"a":1}`, `b`, 2, `{"a":1,"b":2}`, false},
+		{`{"a":{}}`, `a.b"c`, 2, `{"a":{"b\"c":2}}`, false},
+		{`{"a":1}`, `a`, 2, `{"a":2}`, false},
+		{`{"a":[1]}`, `a.1`, 2, `{"a":[1,2]}`, false},
+		{`{"a":1}`, ``, 2, `2`, false},
+		{`{"a":1}`, `b.c`, 2, `{"a":1}`, true},
+		// the object must be valid before insertion, too
+		{`{"a":01}`, `b`, 2, `{"a":01}`, true},
+	}
+	for _, test := range tests {
+		res, err := SetKeyChecked([]byte(test.json), test.path, test.val)
+		if string(res) != test.exp || (err != nil) != test.err {
+			t.Errorf("SetKeyChecked('%s', %q, '%v'): expected ('%s', err=%v), got ('%s', %v)", test.json, test.path, test.val, test.exp, test.err, res, err)
+		}
+	}
+
+	// keys inserted without escaping should be rejected
+	if _, err := validateObject([]byte(`{"a":1,"b"c":2}`), 0, nil); err == nil {
+		t.Error("expected unescaped key to be rejected")
+	}
+}
+
+func TestUnescapeUnicode(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"a":"caf\u00e9"}`, "{\"a\":\"caf\u00e9\"}"},
+		{`{"\u00e9":"\u65e5\u672c"}`, "{\"\u00e9\":\"\u65e5\u672c\"}"},
+		{`["\ud83d\ude00"]`, "[\"\U0001F600\"]"},
+		{`["\uD83D\uDE00!"]`, "[\"\U0001F600!\"]"},
+		{`["\u0022\u005c\u0001\n\"\\"]`, `["\u0022\u005c\u0001\n\"\\"]`},
+		{`["\u2028"]`, `["\u2028"]`},
+		{`["\ud83d", "\ude00x"]`, `["\ud83d", "\ude00x"]`},
+		{`["\\u00e9"]`, `["\\u00e9"]`},
+		{`["\u00zz", "\u00e9"]`, "[\"\\u00zz\", \"\u00e9\"]"},
+		{`["\ufffd"]`, "[\"\uFFFD\"]"},
+		{`{"a":"plain"}`, `{"a":"plain"}`},
+	}
+	for _, test := range tests {
+		if res := UnescapeUnicode([]byte(test.json)); string(res) != test.exp {
+			t.Errorf("UnescapeUnicode(%q): expected %q, got %q", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"a":1}`, `{"a":1}`},
+		{"{\"a\":1 // one\n}", "{\"a\":1 \n}"},
+		{"{\"a\":1} // trailing", `{"a":1} `},
+		{`{/* c */"a":/**/1}`, `{"a":1}`},
+		{"{\"a\":/* multi\nline */1}", `{"a":1}`},
+		{`{"a":"// not a comment"}`, `{"a":"// not a comment"}`},
+		{`{"a":"/* nor this */"}`, `{"a":"/* nor this */"}`},
+		{`{"a":"\"//"} // x`, `{"a":"\"//"} `},
+		{`{"a":1 /* unterminated`, `{"a":1 /* unterminated`},
+		{`{"a":"unterminated // x`, `{"a":"unterminated // x`},
+	}
+	for _, test := range tests {
+		if res := StripComments([]byte(test.json)); string(res) != test.exp {
+			t.Errorf("StripComments(%q): expected %q, got %q", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []string{
+		``, ` `, `1`, ` 1 `, `-0`, `-`, `01`, `1.`, `1.5`, `.5`, `1e5`, `1E+5`, `1e-5`, `1e`, `1e+`, `-1.5e10`,
+		`true`, `tru`, `false`, `null`, `nul`, `nullx`, `truefalse`,
+		`""`, `"`, `"abc`, `"\"\\\/\b\f\n\r\t"`, `"\x"`, `"é"`, `"\u00g9"`, `"\u00e"`, "\"\t\"", "\"\x7f\"",
+		`{}`, `{ }`, `{"a":1}`, `{"a" : 1 , "b" : [ ] }`, `{"a":1,}`, `{,}`, `{"a"}`, `{"a":}`, `{a:1}`, `{"a":1`, `{"a":1}}`, `{"a":1 "b":2}`,
+		`[]`, `[ ]`, `[1,2]`, `[1,]`, `[,1]`, `[1 2]`, `[1`, `[[[]]]`, `[[[]]`, `[{"a":[{}]}]`,
+		`1 2`, `{} {}`, `[] x`,
+	}
+	for _, json := range tests {
+		if err := Validate([]byte(json)); (err == nil) != gojson.Valid([]byte(json)) {
+			t.Errorf("Validate(%q): expected valid=%v, got %v", json, gojson.Valid([]byte(json)), err)
+		}
+	}
+	if err := Validate([]byte(`{"a":1 "b":2}`)); err == nil || err.Error() != `mjson: invalid character '"' at offset 7` {
+		t.Errorf("Validate: unexpected error %v", err)
+	}
+}
+
+func TestValidateOpts(t *testing.T) {
+	opts := &Options{RejectDuplicateKeys: true}
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`{"a":1,"b":2}`, ``},
+		{`{"a":{"a":1},"b":{"a":2}}`, ``},
+		{`[{"a":1},{"a":2}]`, ``},
+		{`{"a":1,"A":2}`, ``},
+		{`{"a":1,"a":2}`, `mjson: duplicate key "a" at offset 7`},
+		{`{"a":1, "b":{"c":1,"c":2}}`, `mjson: duplicate key "c" at offset 19`},
+		{`[0,{"x":1,"y":2,"x":3}]`, `mjson: duplicate key "x" at offset 16`},
+		{`{"a":1,"a":2}`, `mjson: duplicate key "a" at offset 7`},
+		{`{"a":1,"a":}`, `mjson: duplicate key "a" at offset 7`},
+		{`{"a":1,"b":}`, `mjson: invalid character '}' at offset 11`},
+	}
+	for _, test := range tests {
+		err := ValidateOpts([]byte(test.json), opts)
+		if (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("ValidateOpts(%q): expected error %q, got %v", test.json, test.err, err)
+		}
+		if err := Validate([]byte(test.json)); (err == nil) != gojson.Valid([]byte(test.json)) {
+			t.Errorf("Validate(%q): unexpected result %v", test.json, err)
+		}
+	}
+}
+
+type rawMarshaler string
+
+func (r rawMarshaler) MarshalJSON() ([]byte, error) { return []byte(r), nil }
+
+func TestSetValidated(t *testing.T) {
+	tests := []struct {
+		json   string
+		path   string
+		obj    interface{}
+		exp    string
+		experr bool
+	}{
+		{`{"a":1}`, "a", 2, `{"a":2}`, false},
+		{`{"a":1}`, "b", "x", `{"a":1,"b":"x"}`, false},
+		{`{"a":1}`, "a", rawMarshaler(`{"b":2}`), `{"a":{"b":2}}`, false},
+		{`{"a":1}`, "a", rawMarshaler(`{"b":`), `{"a":1}`, true},
+		{`{"a":1}`, "a", rawMarshaler(`1 2`), `{"a":1}`, true},
+		{`{"a":1,"b":tru}`, "a", 2, `{"a":1,"b":tru}`, true},
+	}
+	for _, test := range tests {
+		res, err := SetValidated([]byte(test.json), test.path, test.obj)
+		if (err != nil) != test.experr {
+			t.Errorf("SetValidated(%q, %q, %v): unexpected error result: %v", test.json, test.path, test.obj, err)
+		} else if string(res) != test.exp {
+			t.Errorf("SetValidated(%q, %q, %v): expected %q, got %q", test.json, test.path, test.obj, test.exp, res)
+		}
+	}
+}
+
+func TestSetWithExpiry(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		json string
+		path string
+		val  interface{}
+		exp  string
+	}{
+		{`{}`, `a`, 1, `{"a":{"value":1,"expires":"2030-01-02T03:04:05Z"}}`},
+		{`{"a":{"value":0,"expires":"2000-01-01T00:00:00Z"}}`, `a`, "x", `{"a":{"value":"x","expires":"2030-01-02T03:04:05Z"}}`},
+		{`{"a":[]}`, `a.0`, []int{1}, `{"a":[{"value":[1],"expires":"2030-01-02T03:04:05Z"}]}`},
+		{`{"a":1}`, `a.b`, 1, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if res := SetWithExpiry([]byte(test.json), test.path, test.val, expires); string(res) != test.exp {
+			t.Errorf("SetWithExpiry('%s', %q, '%v'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		}
+	}
+
+	// the offset should be preserved
+	res := SetWithExpiry([]byte(`{}`), "a", nil, time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("", -5*60*60)))
+	var entry struct {
+		Value   interface{}
+		Expires time.Time
+	}
+	if err := gojson.Unmarshal(Get(res, "a"), &entry); err != nil {
+		t.Fatal(err)
+	} else if entry.Value != nil || !entry.Expires.Equal(time.Date(2030, 1, 2, 8, 4, 5, 0, time.UTC)) {
+		t.Errorf("SetWithExpiry: decoded unexpected value %+v", entry)
+	}
+}
+
+func TestSetWithHistory(t *testing.T) {
+	json := []byte(`{"doc":{"status":"new"}}`)
+	json = SetWithHistory(json, "doc.status", "history", "open")
+	if exp := `{"doc":{"status":"open","history":["new"]}}`; string(json) != exp {
+		t.Fatalf("SetWithHistory: expected '%s', got '%s'", exp, json)
+	}
+	json = SetWithHistory(json, "doc.status", "history", "closed")
+	if exp := `{"doc":{"status":"closed","history":["new","open"]}}`; string(json) != exp {
+		t.Fatalf("SetWithHistory: expected '%s', got '%s'", exp, json)
+	}
+
+	tests := []struct {
+		json  string
+		path  string
+		field string
+		exp   string
+	}{
+		{`{"a":{"b":1},"h":null}`, `a`, `h`, `{"a":2,"h":[{"b":1}]}`},
+		{`{"a":1}`, `b`, `h`, `{"a":1,"b":2}`},
+		{`{"a":1,"h":"x"}`, `a`, `h`, `{"a":1,"h":"x"}`},
+		{`{"a":1}`, `a`, `h.i`, `{"a":2,"h.i":[1]}`},
+		{`{"a":[1]}`, `a.0`, `h`, `{"a":[1]}`},
+		{`{"a":1}`, `x.a`, `h`, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if res := SetWithHistory([]byte(test.json), test.path, test.field, 2); string(res) != test.exp {
+			t.Errorf("SetWithHistory('%s', %q, %q): expected '%s', got '%s'", test.json, test.path, test.field, test.exp, res)
+		}
+	}
+}
+
+func TestSetTypedStrict(t *testing.T) {
+	tests := []struct {
+		json   string
+		path   string
+		val    interface{}
+		expect Kind
+		exp    string
+		err    bool
+	}{
+		{`{"a":1}`, `a`, 2, Number, `{"a":2}`, false},
+		{`{"a":{"b":1}}`, `a`, 2, Number, `{"a":{"b":1}}`, true},
+		{`{"a":{"b":1}}`, `a`, map[string]int{}, Object, `{"a":{}}`, false},
+		{`{"a":"x"}`, `a`, "y", String, `{"a":"y"}`, false},
+		{`{"a":null}`, `a`, "y", String, `{"a":null}`, true},
+		{`{"a":1}`, `b`, "y", Number, `{"a":1,"b":"y"}`, false},
+		{`{"a":[1]}`, `a.1`, "y", Number, `{"a":[1,"y"]}`, false},
+		{`{"a":1}`, `b.c`, 2, Number, `{"a":1}`, true},
+		{`[1]`, ``, 2, Array, `2`, false},
+		{`[1]`, ``, 2, Object, `[1]`, true},
+	}
+	for _, test := range tests {
+		res, err := SetTypedStrict([]byte(test.json), test.path, test.val, test.expect)
+		if string(res) != test.exp || (err != nil) != test.err {
+			t.Errorf("SetTypedStrict('%s', %q, '%v', %v): expected ('%s', err=%v), got ('%s', %v)", test.json, test.path, test.val, test.expect, test.exp, test.err, res, err)
+		}
+	}
+	_, err := SetTypedStrict([]byte(`{"a":{}}`), "a", 1, Number)
+	if err == nil || err.Error() != `mjson: value at path "a" is object, not number` {
+		t.Errorf("SetTypedStrict: unexpected error %v", err)
+	}
+}
+
 func TestSetInPlace(t *testing.T) {
 	tests := []struct {
 		json string
@@ -63,27 +794,2183 @@ func TestSetInPlace(t *testing.T) {
 		val  interface{}
 		exp  string
 	}{
-		{`"foo"`, ``, "", `""`},
-		{`"foo"`, ``, "bar", `"bar"`},
-		// object
-		{`{"foo":"bar"}`, `foo`, "baz", `{"foo":"baz"}`},
-		{`{"foo":"bar", "bar":"quux"}`, `bar`, "baz", `{"foo":"bar", "bar":"baz" }`},
-		{`{"foo": {"bar": "baz"}}`, `foo.bar`, 1, `{"foo": {"bar": 1    }}`},
-		{`{"foo":"bar"}`, `bar`, "baz", `{"foo":"bar","bar":"baz"}`},
-		{`{"foo": {}}`, `foo.bar`, "baz", `{"foo": {"bar":"baz"}}`},
-		// array
-		{`[]`, `foo`, "bar", `[]`},
-		{`[10]`, `0`, 1, `[1 ]`},
-		{`[1, 2]`, `0`, "bar", `["bar", 2]`},
-		{`[[1,2], [3,4]]`, `1`, "baz", `[[1,2], "baz"]`},
-		// null
-		{`null`, `foo`, "bar", `null`},
-		{`null`, `0`, 1, `[1] `},
-		{`{"foo": null}`, `foo.0`, 1, `{"foo": [1] }`},
+		{`"foo"`, ``, "", `""`},
+		{`"foo"`, ``, "bar", `"bar"`},
+		// object
+		{`{"foo":"bar"}`, `foo`, "baz", `{"foo":"baz"}`},
+		{`{"foo":"bar", "bar":"quux"}`, `bar`, "baz", `{"foo":"bar", "bar":"baz" }`},
+		{`{"foo": {"bar": "baz"}}`, `foo.bar`, 1, `{"foo": {"bar": 1    }}`},
+		{`{"foo":"bar"}`, `bar`, "baz", `{"foo":"bar","bar":"baz"}`},
+		{`{"foo": {}}`, `foo.bar`, "baz", `{"foo": {"bar":"baz"}}`},
+		// array
+		{`[]`, `foo`, "bar", `[]`},
+		{`[10]`, `0`, 1, `[1 ]`},
+		{`[1, 2]`, `0`, "bar", `["bar", 2]`},
+		{`[[1,2], [3,4]]`, `1`, "baz", `[[1,2], "baz"]`},
+		// null
+		{`null`, `foo`, "bar", `null`},
+		{`null`, `0`, 1, `[1] `},
+		{`{"foo": null}`, `foo.0`, 1, `{"foo": [1] }`},
+	}
+	for _, test := range tests {
+		if res := SetInPlace([]byte(test.json), test.path, test.val); string(res) != test.exp {
+			t.Errorf("SetInPlace('%s', %q, '%s'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestTrailingWhitespace(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		val  interface{}
+		exp  string
+	}{
+		{"{\"a\":1}\n", `a`, 2, "{\"a\":2}\n"},
+		{"{\"a\":1}\n", `a`, "foo", "{\"a\":\"foo\"}\n"},
+		{"{\"a\":1}\n", `b`, 2, "{\"a\":1,\"b\":2}\n"},
+		{"{}\n", `b`, 2, "{\"b\":2}\n"},
+		{"{\"a\":[1]}\n", `a.1`, 2, "{\"a\":[1,2]}\n"},
+		{"{\"a\":null}\r\n", `a.0`, 2, "{\"a\":[2]}\r\n"},
+		{"{\"a\":1}\n\t \n", `a`, 2, "{\"a\":2}\n\t \n"},
+		{" {\"a\":1}\n", ``, 2, " 2\n"},
+		{"[1, 2]\n", ``, "foo", "\"foo\"\n"},
+	}
+	for _, test := range tests {
+		if res := Set([]byte(test.json), test.path, test.val); string(res) != test.exp {
+			t.Errorf("Set(%q, %q, '%v'): expected %q, got %q", test.json, test.path, test.val, test.exp, res)
+		}
+		// SetInPlace may pad shrinking values with whitespace
+		res := SetInPlace([]byte(test.json), test.path, test.val)
+		trailing := test.exp[len(strings.TrimRight(test.exp, " \t\r\n")):]
+		if !bytes.HasSuffix(res, []byte(trailing)) {
+			t.Errorf("SetInPlace(%q, %q, '%v'): trailing whitespace not preserved: %q", test.json, test.path, test.val, res)
+		} else if !bytes.Equal(appendCompact(nil, res), appendCompact(nil, []byte(test.exp))) {
+			t.Errorf("SetInPlace(%q, %q, '%v'): expected %q, got %q", test.json, test.path, test.val, test.exp, res)
+		}
+	}
+
+	// malformed roots are returned unmodified
+	for _, json := range []string{`l`, ` l `, `}`, `]`} {
+		if res := Set([]byte(json), "", 1); string(res) != json {
+			t.Errorf("Set(%q, \"\"): expected original json, got %q", json, res)
+		}
+		if res := SetInPlace([]byte(json), "", 1); string(res) != json {
+			t.Errorf("SetInPlace(%q, \"\"): expected original json, got %q", json, res)
+		}
+	}
+}
+
+func TestSetInPlaceCapacity(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		val  string
+		exp  string
+	}{
+		{`{"foo":"bar"}`, `foo`, `"bazquux"`, `{"foo":"bazquux"}`},
+		{`{"foo":"bar"}`, `baz`, `"quux"`, `{"foo":"bar","baz":"quux"}`},
+		{`{}`, `a`, `"quux"`, `{"a":"quux"}`},
+		{`[1, 2]`, `2`, `3`, `[1, 2,3]`},
+		{`[[], 2]`, `0.0`, `3`, `[[3], 2]`},
+		{`{"foo":null}`, `foo.0`, `"bar"`, `{"foo":["bar"]}`},
+	}
+	for _, test := range tests {
+		json := make([]byte, len(test.json), 64)
+		copy(json, test.json)
+		res := SetRawInPlace(json, test.path, []byte(test.val))
+		if string(res) != test.exp {
+			t.Errorf("SetRawInPlace('%s', %q, '%s'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		} else if &res[0] != &json[0] {
+			t.Errorf("SetRawInPlace('%s', %q, '%s'): result does not share memory with input", test.json, test.path, test.val)
+		}
+	}
+
+	// growing within capacity should not allocate
+	orig := []byte(`{"foo":"bar","baz":[1,2]}`)
+	json := make([]byte, len(orig), 64)
+	val := []byte(`"bazquux"`)
+	allocs := testing.AllocsPerRun(10, func() {
+		json = append(json[:0], orig...)
+		SetRawInPlace(json, "foo", val)
+	})
+	if allocs != 0 {
+		t.Errorf("expected 0 allocations, got %v", allocs)
+	}
+}
+
+func TestSetRawCompact(t *testing.T) {
+	pretty := "{\n  \"b\": [1, 2],\n  \"c\": \"x y\"\n}"
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{`{ "a": 1, "d": 2 }`, "a", `{ "a": {"b":[1,2],"c":"x y"}, "d": 2 }`},
+		{`{ "d": 2 }`, "a", `{ "d": 2 ,"a":{"b":[1,2],"c":"x y"}}`},
+		{`[ 1 ]`, "0", `[ {"b":[1,2],"c":"x y"} ]`},
+		{`{"d":2}`, "x.y", `{"d":2}`},
+	}
+	for _, test := range tests {
+		val := []byte(pretty)
+		if res := SetRawCompact([]byte(test.json), test.path, val); string(res) != test.exp {
+			t.Errorf("SetRawCompact(%q, %q): expected %q, got %q", test.json, test.path, test.exp, res)
+		} else if string(val) != pretty {
+			t.Errorf("SetRawCompact(%q, %q): val was modified", test.json, test.path)
+		}
+	}
+}
+
+func TestSetRawInPlaceShrink(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		val  string
+		exp  string
+	}{
+		{`"foo"`, ``, `""`, `""`},
+		{`{"foo":"bar", "bar":"quux"}`, `bar`, `"baz"`, `{"foo":"bar", "bar":"baz"}`},
+		{`{"foo": {"bar": [1, 2, 3]}, "baz": 3}`, `foo`, `1`, `{"foo": 1, "baz": 3}`},
+		{`[[1,2], [3,4]]`, `0`, `1`, `[1, [3,4]]`},
+		{`{"foo":"bar"}`, `foo`, `"baz"`, `{"foo":"baz"}`},
+		{`{"foo":"bar"}`, `foo`, `"bazquux"`, `{"foo":"bazquux"}`},
+		{`{"foo":"bar"}`, `baz`, `3`, `{"foo":"bar","baz":3}`},
+		{`null`, `0`, `1`, `[1]`},
+		{`{"foo":"bar"}`, `foo.bar`, `3`, `{"foo":"bar"}`},
+	}
+	for _, test := range tests {
+		json := []byte(test.json)
+		res := SetRawInPlaceShrink(json, test.path, []byte(test.val))
+		if string(res) != test.exp {
+			t.Errorf("SetRawInPlaceShrink('%s', %q, '%s'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		} else if len(res) <= len(json) && &res[0] != &json[0] {
+			t.Errorf("SetRawInPlaceShrink('%s', %q, '%s'): result does not share memory with input", test.json, test.path, test.val)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		args []interface{}
+		val  interface{}
+		exp  string
+	}{
+		{`{"users":[{"score":1},{"score":2}]}`, `users.{}.score`, []interface{}{1}, 100, `{"users":[{"score":1},{"score":100}]}`},
+		{`{"users":[{"score":1},{"score":2}]}`, `users.{}.{}`, []interface{}{0, "score"}, 100, `{"users":[{"score":100},{"score":2}]}`},
+		{`{"users":[{"score":1}]}`, `users.{}.{}`, []interface{}{0, "name"}, "foo", `{"users":[{"score":1,"name":"foo"}]}`},
+		{`{"users":[{"score":1}]}`, `users.0.score`, nil, 100, `{"users":[{"score":100}]}`},
+		{`{"users":[{"score":1}]}`, `users.{}.score`, []interface{}{3}, 100, `{"users":[{"score":1}]}`},
+		// mismatched args
+		{`{"users":[{"score":1}]}`, `users.{}.score`, nil, 100, `{"users":[{"score":1}]}`},
+		{`{"users":[{"score":1}]}`, `users.{}.score`, []interface{}{0, 1}, 100, `{"users":[{"score":1}]}`},
+		{`{"users":[{"score":1}]}`, `users.{}.score`, []interface{}{0.5}, 100, `{"users":[{"score":1}]}`},
+	}
+	for _, test := range tests {
+		if res := CompileTemplate(test.path).Set([]byte(test.json), test.args, test.val); string(res) != test.exp {
+			t.Errorf("Template(%q).Set('%s', %v, '%v'): expected '%s', got '%s'", test.path, test.json, test.args, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	var b Builder
+	b.Object()
+	b.Key("a")
+	b.Int(1)
+	b.Key("b")
+	b.Array()
+	b.String("x\"y")
+	b.Float(2.5)
+	b.Object()
+	b.EndObject()
+	b.Array()
+	b.EndArray()
+	b.Null()
+	b.EndArray()
+	b.Key("c")
+	b.Object()
+	b.Key("d")
+	b.Bool(true)
+	b.Key("e")
+	b.Raw([]byte(`[1, 2]`))
+	b.Key("f")
+	b.Value(map[string]int{"g": 3})
+	b.EndObject()
+	b.EndObject()
+	exp := `{"a":1,"b":["x\"y",2.5,{},[],null],"c":{"d":true,"e":[1, 2],"f":{"g":3}}}`
+	if string(b.Bytes()) != exp {
+		t.Errorf("Builder: expected '%s', got '%s'", exp, b.Bytes())
+	}
+	if err := Validate(b.Bytes()); err != nil {
+		t.Error(err)
+	}
+
+	b.Reset()
+	b.Array()
+	b.Int(-1)
+	b.Int(2)
+	b.EndArray()
+	if string(b.Bytes()) != `[-1,2]` {
+		t.Errorf("Builder: expected '[-1,2]', got '%s'", b.Bytes())
+	}
+}
+
+func TestSetMode(t *testing.T) {
+	json := []byte(`{"a":1,"b":[1,2],"c":null,"d":{}}`)
+	tests := []struct {
+		path string
+		exp  Mode
+	}{
+		{"a", Overwrite},
+		{"b.0", Overwrite},
+		{"b.-1", Overwrite},
+		{"d", Overwrite},
+		{"", Overwrite},
+		{"e", InsertKey},
+		{"d.x", InsertKey},
+		{"b.2", AppendArray},
+		{"b.-", AppendArray},
+		{"c.0", ConvertNull},
+		{"c.-", ConvertNull},
+		{"b.3", NoOp},
+		{"c.1", NoOp},
+		{"a.b", NoOp},
+		{"e.f", NoOp},
+	}
+	for _, test := range tests {
+		if res := SetMode(json, test.path); res != test.exp {
+			t.Errorf("SetMode(%q): expected %v, got %v", test.path, test.exp, res)
+		}
+		// check that SetMode agrees with Set
+		res := Set(json, test.path, true)
+		if unchanged := string(res) == string(json); unchanged != (test.exp == NoOp) {
+			t.Errorf("SetMode(%q): Set result %q disagrees with %v", test.path, res, test.exp)
+		}
+	}
+	for _, json := range []string{`}`, `]`, `l`} {
+		if res := SetMode([]byte(json), ""); res != NoOp {
+			t.Errorf("SetMode(%q): expected NoOp for malformed root, got %v", json, res)
+		}
+	}
+}
+
+func TestRootKind(t *testing.T) {
+	tests := []struct {
+		json string
+		kind Kind
+	}{
+		{``, Invalid},
+		{` 	`, Invalid},
+		{`{}`, Object},
+		{` {"foo":[]}`, Object},
+		{`[1,2]`, Array},
+		{"\n[]", Array},
+		{`"foo"`, String},
+		{`-3.1`, Number},
+		{`0`, Number},
+		{`true`, Bool},
+		{`false`, Bool},
+		{`null`, Null},
+		{`}`, Invalid},
+	}
+	for _, test := range tests {
+		if kind := RootKind([]byte(test.json)); kind != test.kind {
+			t.Errorf("RootKind(%q): expected %v, got %v", test.json, test.kind, kind)
+		}
+	}
+}
+
+func TestGetTyped(t *testing.T) {
+	json := []byte(`{"o":{"x": 1},"a":[1],"s":"x","n":-1.5,"b":false,"z":null}`)
+	tests := []struct {
+		path string
+		raw  string
+		kind Kind
+		ok   bool
+	}{
+		{`o`, `{"x": 1}`, Object, true},
+		{`a`, `[1]`, Array, true},
+		{`s`, `"x"`, String, true},
+		{`n`, `-1.5`, Number, true},
+		{`b`, `false`, Bool, true},
+		{`z`, `null`, Null, true},
+		{`x`, ``, Invalid, false},
+		{`a.1`, ``, Invalid, false},
+	}
+	for _, test := range tests {
+		if raw, kind, ok := GetTyped(json, test.path); string(raw) != test.raw || kind != test.kind || ok != test.ok {
+			t.Errorf("GetTyped(%q): expected ('%s', %v, %v), got ('%s', %v, %v)", test.path, test.raw, test.kind, test.ok, raw, kind, ok)
+		}
+	}
+}
+
+func TestGetIntChecked(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  int64
+		err  string
+	}{
+		{`{"a":42}`, 42, ``},
+		{`{"a":-9223372036854775808}`, math.MinInt64, ``},
+		{`{"a":9223372036854775807}`, math.MaxInt64, ``},
+		{`{"a":1.0}`, 1, ``},
+		{`{"a":-2.5e1}`, -25, ``},
+		{`{"a":1e3}`, 1000, ``},
+		{`{"a":9007199254740993.0}`, 9007199254740993, ``},
+		{`{"a":9.223372036854775807e18}`, math.MaxInt64, ``},
+		{`{"a":0.05e2}`, 5, ``},
+		{`{"a":-0.0}`, 0, ``},
+		{`{"a":1.5}`, 0, `mjson: number 1.5 at "a" is not an integer`},
+		{`{"a":1.0000000000000001}`, 0, `mjson: number 1.0000000000000001 at "a" is not an integer`},
+		{`{"a":5e-1}`, 0, `mjson: number 5e-1 at "a" is not an integer`},
+		{`{"a":1e-99999999999999999999}`, 0, `mjson: number 1e-99999999999999999999 at "a" is not an integer`},
+		{`{"a":9.223372036854775808e18}`, 0, `mjson: number 9.223372036854775808e18 at "a" overflows int64`},
+		{`{"a":9223372036854775808}`, 0, `mjson: number 9223372036854775808 at "a" overflows int64`},
+		{`{"a":-1e19}`, 0, `mjson: number -1e19 at "a" overflows int64`},
+		{`{"a":1e400}`, 0, `mjson: number 1e400 at "a" overflows int64`},
+		{`{"a":"1"}`, 0, `mjson: value at "a" is string, not a number`},
+		{`{"b":1}`, 0, `mjson: malformed path "a"`},
+	}
+	for _, test := range tests {
+		n, err := GetIntChecked([]byte(test.json), "a")
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("GetIntChecked(%q): expected error %q, got %v", test.json, test.err, err)
+			}
+		} else if err != nil || n != test.exp {
+			t.Errorf("GetIntChecked(%q): expected %v, got %v (%v)", test.json, test.exp, n, err)
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	json := []byte(`{"s":"","a":[],"a2":[ ],"o":{},"z":null,"n":0,"n2":-0.0,` +
+		`"S":" ","A":[0],"O":{"":0},"N":0.1,"f":false,"t":true}`)
+	tests := []struct {
+		path  string
+		empty bool
+	}{
+		{`s`, true},
+		{`a`, true},
+		{`a2`, true},
+		{`o`, true},
+		{`z`, true},
+		{`n`, true},
+		{`n2`, true},
+		{`S`, false},
+		{`A`, false},
+		{`O`, false},
+		{`N`, false},
+		{`f`, false},
+		{`t`, false},
+		{`x`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		if empty := IsEmpty(json, test.path); empty != test.empty {
+			t.Errorf("IsEmpty(%q): expected %v, got %v", test.path, test.empty, empty)
+		}
+	}
+}
+
+func TestIsContainer(t *testing.T) {
+	json := []byte(`{"o":{},"a":[1],"s":"x","n":1,"b":true,"z":null}`)
+	tests := []struct {
+		path      string
+		kind      Kind
+		container bool
+	}{
+		{``, Object, true},
+		{`o`, Object, true},
+		{`a`, Array, true},
+		{`a.0`, Number, false},
+		{`s`, String, false},
+		{`n`, Number, false},
+		{`b`, Bool, false},
+		{`z`, Null, false},
+		{`x`, Invalid, false},
+		{`a.1`, Invalid, false},
+		{`o.x`, Invalid, false},
+	}
+	for _, test := range tests {
+		if k := Type(json, test.path); k != test.kind {
+			t.Errorf("Type(%q): expected %v, got %v", test.path, test.kind, k)
+		}
+		if c := IsContainer(json, test.path); c != test.container {
+			t.Errorf("IsContainer(%q): expected %v, got %v", test.path, test.container, c)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{``, ``, ``},
+		{`"foo"`, ``, `"foo"`},
+		{` 3 `, ``, `3`},
+		// object
+		{`{"foo":"bar"}`, `foo`, `"bar"`},
+		{`{"foo":"bar", "bar": {"baz":3}}`, `bar`, `{"baz":3}`},
+		{`{"foo":"bar", "bar": {"baz":3}}`, `bar.baz`, `3`},
+		{`{"foo":null}`, `foo`, `null`},
+		{`{"foo":"bar"}`, `bar`, ``},
+		{`{"foo":"bar"}`, `foo.bar`, ``},
+		// array
+		{`[1, 2]`, `1`, `2`},
+		{`[1, [true, false]]`, `1.1`, `false`},
+		{`[1, 2]`, `2`, ``},
+		{`[1, 2]`, `foo`, ``},
+		// null
+		{`null`, `0`, ``},
+		{`{"foo":null}`, `foo.0`, ``},
+	}
+	for _, test := range tests {
+		if res := Get([]byte(test.json), test.path); string(res) != test.exp {
+			t.Errorf("Get('%s', %q): expected '%s', got '%s'", test.json, test.path, test.exp, res)
+		}
+	}
+}
+
+func TestGetContainer(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{`{"a":{"b":1}}`, `a`, `{"b":1}`},
+		{`{"a": { "b" : 1 } }`, `a`, `{ "b" : 1 }`},
+		{"{\"a\":{\n\t\"b\": [1,\n 2]\n}\n}", `a`, "{\n\t\"b\": [1,\n 2]\n}"},
+		{"{\"a\":{\n\t\"b\": [1,\n 2]\n}\n}", `a.b`, "[1,\n 2]"},
+		{`[ [ ], {} ]`, `0`, `[ ]`},
+		{`{"a":["}", "]"]}`, `a`, `["}", "]"]`},
+		{"\t{ \"a\" : 1 }\n", ``, `{ "a" : 1 }`},
+	}
+	for _, test := range tests {
+		if res := Get([]byte(test.json), test.path); string(res) != test.exp {
+			t.Errorf("Get(%q, %q): expected %q, got %q", test.json, test.path, test.exp, res)
+		}
+	}
+}
+
+func TestGetOpts(t *testing.T) {
+	big := `"` + strings.Repeat("x", 100) + `"`
+	tests := []struct {
+		json    string
+		path    string
+		maxScan int
+		exp     string
+	}{
+		{`{"a":` + big + `,"b":1}`, "b", 0, `1`},
+		{`{"a":` + big + `,"b":1}`, "b", 200, `1`},
+		{`{"a":` + big + `,"b":1}`, "b", 102, `1`},
+		{`{"a":` + big + `,"b":1}`, "b", 101, ``},
+		{`{"a":` + big + `,"b":1}`, "b", 10, ``},
+		{`{"a":` + big + `,"b":1}`, "a", 10, big},
+		{`[` + big + `,2]`, "1", 10, ``},
+		{`[` + big + `,2]`, "1", 102, `2`},
+		{`[` + big + `,2]`, "-1", 10, ``},
+		{`[` + big + `,2]`, "-1", 102, `2`},
+		{`{"a":[1,2,3,4,5,6,7,8,9],"b":true}`, "b", 10, ``},
+		{`{"a":123456789,"b":true}`, "b", 8, ``},
+		{`{"a":123456789,"b":true}`, "b", 9, `true`},
+		{`{"a":true,"b":false,"c":null}`, "c", 1, ``},
+		{`{"a":1,"b":{"c":2}}`, "b.c", 1, `2`},
+		{`{"a":{"x":1},"b":[{"n":1}]}`, "b.#(n=1)", 7, `{"n":1}`},
+	}
+	for _, test := range tests {
+		if res := GetOpts([]byte(test.json), test.path, &Options{MaxScan: test.maxScan}); string(res) != test.exp {
+			t.Errorf("GetOpts(%q, %q, MaxScan: %v): expected %q, got %q", test.json, test.path, test.maxScan, test.exp, res)
+		}
+	}
+
+	if res := GetOpts([]byte(`{"A":1}`), "a", &Options{CaseInsensitive: true}); string(res) != `1` {
+		t.Errorf("GetOpts with CaseInsensitive: expected 1, got %q", res)
+	}
+	if res := GetOpts([]byte(`{"\u0041":1}`), "a", &Options{CaseInsensitive: true}); string(res) != `1` {
+		t.Errorf("GetOpts with escaped key: expected 1, got %q", res)
+	}
+	if res := GetOpts([]byte(`{"\u0061":1}`), "a", &Options{}); string(res) != `1` {
+		t.Errorf("GetOpts with escaped key: expected 1, got %q", res)
+	}
+	if res := GetOpts([]byte(`{"a":1}`), "b", &Options{CreatePath: true}); res != nil {
+		t.Errorf("GetOpts with CreatePath: expected nil, got %q", res)
+	}
+	json := `{"a":` + big + `,"b":1}`
+	if res := SetOpts([]byte(json), "b", 2, &Options{MaxScan: 10}); string(res) != json {
+		t.Errorf("SetOpts with MaxScan: expected original json, got %q", res)
+	}
+	json = `[` + big + `,2]`
+	for _, path := range []string{"2", "-", "-1"} {
+		if res := SetOpts([]byte(json), path, 3, &Options{MaxScan: 10}); string(res) != json {
+			t.Errorf("SetOpts(%q) with MaxScan: expected original json, got %q", path, res)
+		}
+	}
+	if res := SetOpts([]byte(json), "-", 3, &Options{MaxScan: 102}); string(res) != `[`+big+`,2,3]` {
+		t.Errorf("SetOpts(\"-\") with MaxScan: expected append, got %q", res)
+	}
+	if res := SetOpts([]byte(json), "-1", 3, &Options{MaxScan: 102}); string(res) != `[`+big+`,3]` {
+		t.Errorf("SetOpts(\"-1\") with MaxScan: expected overwrite, got %q", res)
+	}
+}
+
+func TestValueSize(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		size int
+	}{
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, `a`, 13},
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, `a.b`, 6},
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, `a.b.1`, 1},
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, `c`, 5},
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, ``, 29},
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, `d`, -1},
+		{`{"a":{"b": [1, 2]},"c":"foo"}`, `a.b.2`, -1},
+		{``, ``, -1},
+	}
+	for _, test := range tests {
+		if size := ValueSize([]byte(test.json), test.path); size != test.size {
+			t.Errorf("ValueSize('%s', %q): expected %v, got %v", test.json, test.path, test.size, size)
+		}
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	json := []byte(`{"a":1,"b":"two","c":[3]}`)
+	buf := make([]byte, 0, 64)
+	for _, test := range []struct {
+		path string
+		exp  string
+		ok   bool
+	}{
+		{"a", `1`, true},
+		{"b", `"two"`, true},
+		{"x", ``, false},
+		{"c", `[3]`, true},
+	} {
+		res, ok := GetInto(buf[:0], json, test.path)
+		if ok != test.ok || string(res) != test.exp {
+			t.Errorf("GetInto(%q): expected %q (%v), got %q (%v)", test.path, test.exp, test.ok, res, ok)
+		} else if cap(res) != cap(buf) || (len(res) > 0 && &res[0] != &buf[:1][0]) {
+			t.Errorf("GetInto(%q): buffer was not reused", test.path)
+		}
+	}
+
+	// appends to existing contents
+	res, _ := GetInto([]byte("["), json, "a")
+	res, _ = GetInto(append(res, ','), json, "c")
+	if string(res) != `[1,[3]` {
+		t.Errorf("GetInto: expected %q, got %q", `[1,[3]`, res)
+	}
+
+	// result does not alias json
+	res, _ = GetInto(nil, json, "a")
+	res[0] = '9'
+	if string(json) != `{"a":1,"b":"two","c":[3]}` {
+		t.Errorf("GetInto: result aliases json")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	json := []byte(`{"a":{"b":[1,2]}}`)
+	val := Extract(json, "a.b")
+	if string(val) != `[1,2]` {
+		t.Fatalf("Extract: expected '[1,2]', got '%s'", val)
+	}
+	val[1] = '3'
+	val = append(val[:len(val)-1], ",4]"...)
+	if string(json) != `{"a":{"b":[1,2]}}` {
+		t.Errorf("Extract: modifying result changed original json: '%s'", json)
+	}
+	if val := Extract(json, "a.c"); val != nil {
+		t.Errorf("Extract: expected nil for missing path, got '%s'", val)
+	}
+}
+
+func TestCompactClone(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{``, ``},
+		{` 1 `, `1`},
+		{"{\n\t\"a\": [1, 2],\r\n\t\"b\": {\"c\" : \"x y\"}\n}\n", `{"a":[1,2],"b":{"c":"x y"}}`},
+		{`[" \" ", "\\", " "]`, `[" \" ","\\"," "]`},
+	}
+	for _, test := range tests {
+		if res := CompactClone([]byte(test.json)); string(res) != test.exp {
+			t.Errorf("CompactClone('%s'): expected '%s', got '%s'", test.json, test.exp, res)
+		}
+	}
+
+	// should not share memory with the original
+	json := []byte(`{"a":1}`)
+	res := CompactClone(json)
+	res[5] = '2'
+	if string(json) != `{"a":1}` {
+		t.Errorf("CompactClone: modifying result changed original json: '%s'", json)
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	json := []byte(`{"a":{"x": [1, 2]},"b":{"x":[1,2]},"c":1,"d":"1","e":1}`)
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`a`, `b`, true},
+		{`a.x`, `b.x`, true},
+		{`c`, `e`, true},
+		{`a`, `a`, true},
+		{`c`, `d`, false},
+		{`a.x.0`, `c`, true},
+		{`a.x.1`, `c`, false},
+		{`c`, `f`, false},
+		{`f`, `g`, false},
+	}
+	for _, test := range tests {
+		if same := SameValue(json, test.a, test.b); same != test.same {
+			t.Errorf("SameValue(%q, %q): expected %v, got %v", test.a, test.b, test.same, same)
+		}
+	}
+}
+
+func TestEqualValue(t *testing.T) {
+	tests := []struct {
+		a, b string
+		exp  bool
+	}{
+		{`{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, true},
+		{`{"a":1,"b":[1,2]}`, " {\n  \"b\": [ 1, 2 ],\n  \"a\": 1\n} ", true},
+		{`{"a":{"x":true,"y":null}}`, `{"a":{"y":null,"x":true}}`, true},
+		{`{"ab":"\u00e9"}`, "{\"ab\":\"é\"}", true},
+		{`{"ab":"\/"}`, `{"ab":"/"}`, true},
+		{`[]`, `[ ]`, true},
+		{`{}`, `{ }`, true},
+		{`{"a":1}`, `{"a":2}`, false},
+		{`{"a":1}`, `{"a":1,"b":2}`, false},
+		{`{"a":1,"b":2}`, `{"a":1}`, false},
+		{`{"a":1}`, `{"b":1}`, false},
+		{`[1,2]`, `[2,1]`, false},
+		{`[1,2]`, `[1,2,3]`, false},
+		{`"1"`, `1`, false},
+		{`1`, `1.0`, false},
+		{`true`, `false`, false},
+		{`{"a":[{"b":1}]}`, `{"a":[{"b":"1"}]}`, false},
+		{`{"a":1`, `{"a":1`, false},
+		{``, ``, false},
+	}
+	for _, test := range tests {
+		if res := EqualValue([]byte(test.a), []byte(test.b)); res != test.exp {
+			t.Errorf("EqualValue(%q, %q): expected %v, got %v", test.a, test.b, test.exp, res)
+		}
+	}
+}
+
+func TestCompactPath(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{"{\n  \"a\": { \"b\" : [1, 2] },\n  \"c\": [ 3 ]\n}", `a`, "{\n  \"a\": {\"b\":[1,2]},\n  \"c\": [ 3 ]\n}"},
+		{"{\n  \"a\": { \"b\" : [1, 2] },\n  \"c\": [ 3 ]\n}", `a.b`, "{\n  \"a\": { \"b\" : [1,2] },\n  \"c\": [ 3 ]\n}"},
+		{"{\n  \"a\": { \"b\" : \"x y\" }\n}", `a`, "{\n  \"a\": {\"b\":\"x y\"}\n}"},
+		{" [ 1, 2 ]\n", ``, " [1,2]\n"},
+		{`{"a":1}`, `b`, `{"a":1}`},
+	}
+	for _, test := range tests {
+		json := []byte(test.json)
+		if res := CompactPath(json, test.path); string(res) != test.exp {
+			t.Errorf("CompactPath(%q, %q): expected %q, got %q", test.json, test.path, test.exp, res)
+		} else if len(res) > 0 && &res[0] != &json[0] {
+			t.Errorf("CompactPath(%q, %q): should not allocate", test.json, test.path)
+		}
+	}
+}
+
+func TestGetRaw(t *testing.T) {
+	json := []byte(`{"user":{"name":"alice","tags":["a","b"]}}`)
+	raw := GetRaw(json, "user")
+	var user struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := gojson.Unmarshal(raw, &user); err != nil {
+		t.Fatal(err)
+	} else if user.Name != "alice" || len(user.Tags) != 2 {
+		t.Errorf("GetRaw: decoded unexpected value %+v", user)
+	}
+	raw[0] = 'x'
+	if json[8] != '{' {
+		t.Error("GetRaw: modifying result changed original json")
+	}
+	if raw := GetRaw(json, "group"); raw != nil {
+		t.Errorf("GetRaw: expected nil for missing path, got '%s'", raw)
+	}
+}
+
+func TestShrinkToFit(t *testing.T) {
+	json := make([]byte, 0, 100)
+	json = append(json, `{"a":"xxxxxxxx"}`...)
+	json = SetInPlace(json, "a", 1)
+	res := ShrinkToFit(json)
+	if string(res) != string(json) {
+		t.Errorf("ShrinkToFit: expected '%s', got '%s'", json, res)
+	} else if cap(res) != len(res) {
+		t.Errorf("ShrinkToFit: expected cap %v, got %v", len(res), cap(res))
+	} else if &res[0] == &json[0] {
+		t.Error("ShrinkToFit: result shares memory with original")
+	}
+	if res := ShrinkToFit(nil); len(res) != 0 || cap(res) != 0 {
+		t.Errorf("ShrinkToFit: expected empty result, got '%s' (cap %v)", res, cap(res))
+	}
+}
+
+func TestGetResolved(t *testing.T) {
+	json := []byte(`{
+		"defs": {"x": {"v": 1}, "y": {"$ref": "defs.x"}, "z": {"$ref": "defs.y"}},
+		"a": {"$ref": "defs.x"},
+		"b": {"$ref": "defs.z"},
+		"c": {"$ref": "missing"},
+		"d": {"$ref": "e"},
+		"e": {"$ref": "d"},
+		"f": {"$ref": "f"},
+		"g": {"$ref": "defs.x", "other": 1},
+		"h": {"$ref": 7},
+		"i": {"$ref": "defs.x.v"}
+	}`)
+	tests := []struct {
+		path string
+		exp  string
+	}{
+		{"a", `{"v": 1}`},
+		{"b", `{"v": 1}`},
+		{"i", `1`},
+		{"defs.x.v", `1`},
+		{"c", ``},
+		{"d", ``},
+		{"f", ``},
+		{"g", `{"$ref": "defs.x", "other": 1}`},
+		{"h", `{"$ref": 7}`},
+		{"nope", ``},
+	}
+	for _, test := range tests {
+		res := GetResolved(json, test.path)
+		if string(res) != test.exp {
+			t.Errorf("GetResolved(%q): expected %q, got %q", test.path, test.exp, res)
+		} else if test.exp == "" && res != nil {
+			t.Errorf("GetResolved(%q): expected nil, got %q", test.path, res)
+		}
+	}
+}
+
+func TestGetFirst(t *testing.T) {
+	json := []byte(`{"oldName":1,"a":{"b":null}}`)
+	tests := []struct {
+		paths []string
+		exp   string
+	}{
+		{[]string{"newName", "oldName"}, `1`},
+		{[]string{"oldName", "newName"}, `1`},
+		{[]string{"a.c", "a.b", "oldName"}, `null`},
+		{[]string{"x", "y.z"}, ``},
+		{nil, ``},
+	}
+	for _, test := range tests {
+		res := GetFirst(json, test.paths...)
+		if string(res) != test.exp {
+			t.Errorf("GetFirst(%q): expected %q, got %q", test.paths, test.exp, res)
+		} else if test.exp == "" && res != nil {
+			t.Errorf("GetFirst(%q): expected nil, got %q", test.paths, res)
+		}
+	}
+}
+
+func TestGetOr(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		def  string
+		exp  string
+	}{
+		{`{"foo":"bar"}`, `foo`, `3`, `"bar"`},
+		{`{"foo":null}`, `foo`, `3`, `null`},
+		{`{"foo":"bar"}`, `bar`, `3`, `3`},
+		{`{"foo":[]}`, `foo.0`, `3`, `3`},
+		{`[]`, `foo`, `3`, `3`},
+	}
+	for _, test := range tests {
+		if res := GetOr([]byte(test.json), test.path, []byte(test.def)); string(res) != test.exp {
+			t.Errorf("GetOr('%s', %q, '%s'): expected '%s', got '%s'", test.json, test.path, test.def, test.exp, res)
+		}
+	}
+}
+
+func TestParent(t *testing.T) {
+	tests := []struct {
+		json    string
+		path    string
+		start   int
+		isArray bool
+		ok      bool
+	}{
+		{`{"foo":"bar"}`, `foo`, 0, false, true},
+		{` {"foo":"bar"}`, `bar`, 1, false, true},
+		{`{"foo": {"bar": 3}}`, `foo.bar`, 8, false, true},
+		{`{"foo": {"bar": 3}}`, `foo.baz`, 8, false, true},
+		{`{"foo": [{}, [1, 2]]}`, `foo.1.0`, 13, true, true},
+		{`{"foo": [{}, [1, 2]]}`, `foo.1`, 8, true, true},
+		{`[1, 2]`, `5`, 0, true, true},
+		// no parent
+		{`{"foo":"bar"}`, ``, 0, false, false},
+		{`{"foo":"bar"}`, `foo.bar`, 0, false, false},
+		{`{"foo":null}`, `foo.0`, 0, false, false},
+		{`{"foo":{}}`, `bar.baz`, 0, false, false},
+		{`3`, `foo`, 0, false, false},
+	}
+	for _, test := range tests {
+		if start, isArray, ok := Parent([]byte(test.json), test.path); start != test.start || isArray != test.isArray || ok != test.ok {
+			t.Errorf("Parent('%s', %q): expected (%v, %v, %v), got (%v, %v, %v)", test.json, test.path, test.start, test.isArray, test.ok, start, isArray, ok)
+		}
+	}
+}
+
+func TestSetBefore(t *testing.T) {
+	tests := []struct {
+		json   string
+		path   string
+		before string
+		val    interface{}
+		exp    string
+	}{
+		{`{"a":1,"b":2,"c":3}`, `z`, `a`, 0, `{"z":0,"a":1,"b":2,"c":3}`},
+		{`{"a":1, "b":2, "c":3}`, `z`, `b`, 0, `{"a":1, "z":0,"b":2, "c":3}`},
+		{`{"a":1,"b":2,"c":3}`, `z`, `c`, 0, `{"a":1,"b":2,"z":0,"c":3}`},
+		{`{"foo":{"a":1}}`, `foo.z`, `a`, 0, `{"foo":{"z":0,"a":1}}`},
+		{`[{"a":1}]`, `0.z`, `a`, 0, `[{"z":0,"a":1}]`},
+		// existing key is replaced in place
+		{`{"a":1,"b":2,"c":3}`, `c`, `a`, 0, `{"a":1,"b":2,"c":0}`},
+		{`{"a":1,"b":2}`, `a`, `b`, 0, `{"a":0,"b":2}`},
+		{`{"a":1,"b":2}`, `a`, `y`, 0, `{"a":0,"b":2}`},
+		// no-ops
+		{`{"a":1,"b":2}`, `z`, `y`, 0, `{"a":1,"b":2}`},
+		{`{}`, `z`, `a`, 0, `{}`},
+		{`{"foo":[1]}`, `foo.z`, `a`, 0, `{"foo":[1]}`},
+		{`{"foo":{"a":1}}`, `bar.z`, `a`, 0, `{"foo":{"a":1}}`},
+	}
+	for _, test := range tests {
+		if res := SetBefore([]byte(test.json), test.path, test.before, test.val); string(res) != test.exp {
+			t.Errorf("SetBefore('%s', %q, %q, '%v'): expected '%s', got '%s'", test.json, test.path, test.before, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestSetWhenSibling(t *testing.T) {
+	tests := []struct {
+		json   string
+		path   string
+		field  string
+		equals string
+		val    interface{}
+		exp    string
+	}{
+		{`{"status":"done","result":null}`, `result`, `status`, `"done"`, 1, `{"status":"done","result":1}`},
+		{`{"status":"done"}`, `result`, `status`, `"done"`, 1, `{"status":"done","result":1}`},
+		{`{"status":"pending","result":null}`, `result`, `status`, `"done"`, 1, `{"status":"pending","result":null}`},
+		{`{"status":"done"}`, `result`, `state`, `"done"`, 1, `{"status":"done"}`},
+		{`{"jobs":[{"s":{"a": 1},"r":0}]}`, `jobs.0.r`, `s`, `{ "a":1 }`, 1, `{"jobs":[{"s":{"a": 1},"r":1}]}`},
+		{`{"jobs":[{"s":1}]}`, `jobs.1.r`, `s`, `1`, 1, `{"jobs":[{"s":1}]}`},
+		{`{"jobs":[1,2]}`, `jobs.0`, `s`, `1`, 1, `{"jobs":[1,2]}`},
+		{`{"status":"done"}`, ``, `status`, `"done"`, 1, `{"status":"done"}`},
+	}
+	for _, test := range tests {
+		if res := SetWhenSibling([]byte(test.json), test.path, test.field, []byte(test.equals), test.val); string(res) != test.exp {
+			t.Errorf("SetWhenSibling('%s', %q, %q, '%s', '%v'): expected '%s', got '%s'", test.json, test.path, test.field, test.equals, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestToggle(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  string
+	}{
+		{`true`, ``, `false`},
+		{`false`, ``, `true `},
+		{`{"foo":true}`, `foo`, `{"foo":false}`},
+		{`{"foo":false,"bar":1}`, `foo`, `{"foo":true ,"bar":1}`},
+		{`[1, [false]]`, `1.0`, `[1, [true ]]`},
+		// non-booleans
+		{`{"foo":"true"}`, `foo`, `{"foo":"true"}`},
+		{`{"foo":null}`, `foo`, `{"foo":null}`},
+		{`{"foo":1}`, `foo`, `{"foo":1}`},
+		{`{"foo":true}`, `bar`, `{"foo":true}`},
+	}
+	for _, test := range tests {
+		if res := Toggle([]byte(test.json), test.path); string(res) != test.exp {
+			t.Errorf("Toggle('%s', %q): expected '%s', got '%s'", test.json, test.path, test.exp, res)
+		}
+	}
+
+	// toggling twice should restore the original value
+	json := []byte(`{"foo":true}`)
+	if res := Toggle(Toggle(json, "foo"), "foo"); string(res) != `{"foo":true }` {
+		t.Errorf("expected '%s', got '%s'", `{"foo":true }`, res)
+	}
+}
+
+func TestSetPrefixed(t *testing.T) {
+	tests := []struct {
+		json   string
+		path   string
+		prefix string
+		val    interface{}
+		exp    string
+	}{
+		{`{"flag.a":1, "other":2, "flag.b":3}`, ``, `flag.`, false, `{"flag.a":false, "other":2, "flag.b":false}`},
+		{`{"foo":{"flag.a":{"x":1}, "flag.b": [1,2]}}`, `foo`, `flag.`, true, `{"foo":{"flag.a":true, "flag.b": true}}`},
+		{`{"foo":{"bar":1}}`, `foo`, `flag.`, true, `{"foo":{"bar":1}}`},
+		{`{"foo":{"bar":1, "baz":2}}`, `foo`, ``, 0, `{"foo":{"bar":0, "baz":0}}`},
+		{`{"foo":{}}`, `foo`, `flag.`, true, `{"foo":{}}`},
+		{`{"fl\u0061g.x":1, "flag\/y":2}`, ``, `flag.`, 0, `{"fl\u0061g.x":0, "flag\/y":2}`},
+		// non-objects
+		{`{"foo":["flag.a"]}`, `foo`, `flag.`, true, `{"foo":["flag.a"]}`},
+		{`{"foo":{"flag.a":1}}`, `bar`, `flag.`, true, `{"foo":{"flag.a":1}}`},
+	}
+	for _, test := range tests {
+		if res := SetPrefixed([]byte(test.json), test.path, test.prefix, test.val); string(res) != test.exp {
+			t.Errorf("SetPrefixed('%s', %q, %q, '%v'): expected '%s', got '%s'", test.json, test.path, test.prefix, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestSetPrefixedN(t *testing.T) {
+	var b Builder
+	b.Object()
+	for i := 0; i < 1000; i++ {
+		b.Key("flag." + strconv.Itoa(i))
+		b.Int(1)
+	}
+	b.EndObject()
+	json := b.Bytes()
+
+	res := SetPrefixedN(json, "", "flag.", 0, 3)
+	var edited int
+	for _, m := range Members(res, "") {
+		if string(m.Value) == "0" {
+			edited++
+		}
+	}
+	if edited != 3 {
+		t.Fatalf("SetPrefixedN: expected 3 edits, got %v", edited)
+	}
+	for i := 0; i < 3; i++ {
+		if v := Get(res, "flag\\."+strconv.Itoa(i)); string(v) != "0" {
+			t.Errorf("SetPrefixedN: expected flag.%v to be edited, got %s", i, v)
+		}
+	}
+
+	tests := []struct {
+		limit int
+		exp   string
+	}{
+		{0, `{"flag.a":0,"x":1,"flag.b":0}`},
+		{-1, `{"flag.a":0,"x":1,"flag.b":0}`},
+		{1, `{"flag.a":0,"x":1,"flag.b":1}`},
+		{2, `{"flag.a":0,"x":1,"flag.b":0}`},
+		{5, `{"flag.a":0,"x":1,"flag.b":0}`},
+	}
+	for _, test := range tests {
+		if res := SetPrefixedN([]byte(`{"flag.a":1,"x":1,"flag.b":1}`), "", "flag.", 0, test.limit); string(res) != test.exp {
+			t.Errorf("SetPrefixedN(%v): expected %q, got %q", test.limit, test.exp, res)
+		}
+	}
+}
+
+func TestArrayCursor(t *testing.T) {
+	json := []byte(` [{"id":0}, "foo", 2 , [3]]`)
+	c := ArrayCursor(json)
+	if c.Len() != 4 {
+		t.Fatalf("expected 4 elements, got %v", c.Len())
+	}
+	for i, exp := range []string{`{"id":0}`, `"foo"`, `2`, `[3]`, ``} {
+		if res := c.Get(i); string(res) != exp {
+			t.Errorf("Get(%v): expected '%s', got '%s'", i, exp, res)
+		}
+	}
+
+	// grow, shrink, and replace with the same length
+	c.Set(1, "foobar")
+	c.Set(0, 0)
+	c.Set(2, 5)
+	c.Set(4, "out of range")
+	for i, exp := range []string{`0`, `"foobar"`, `5`, `[3]`} {
+		if res := c.Get(i); string(res) != exp {
+			t.Errorf("Get(%v): expected '%s', got '%s'", i, exp, res)
+		}
+	}
+	if exp := ` [0, "foobar", 5 , [3]]`; string(c.Bytes()) != exp {
+		t.Errorf("expected '%s', got '%s'", exp, c.Bytes())
+	}
+	if exp := ` [{"id":0}, "foo", 2 , [3]]`; string(json) != exp {
+		t.Errorf("original json was modified: '%s'", json)
+	}
+
+	if c := ArrayCursor([]byte(`[]`)); c.Len() != 0 || c.Get(0) != nil {
+		t.Error("expected empty cursor")
+	}
+	if c := ArrayCursor([]byte(`{"foo":[]}`)); c != nil {
+		t.Error("expected nil cursor for non-array")
+	}
+}
+
+func TestHead(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		n    int
+		exp  []string
+	}{
+		{`{"a":[0, "1", [2], {"3":3}]}`, `a`, 2, []string{`0`, `"1"`}},
+		{`{"a":[0, "1", [2], {"3":3}]}`, `a`, 0, []string{}},
+		{`{"a":[0, "1", [2], {"3":3}]}`, `a`, 10, []string{`0`, `"1"`, `[2]`, `{"3":3}`}},
+		{`{"a":[]}`, `a`, 2, []string{}},
+		{`[1,2]`, ``, 1, []string{`1`}},
+		{`{"a":{}}`, `a`, 2, nil},
+		{`{"a":[1,2]}`, `b`, 2, nil},
+	}
+	for _, test := range tests {
+		vals := Head([]byte(test.json), test.path, test.n)
+		if (vals == nil) != (test.exp == nil) || len(vals) != len(test.exp) {
+			t.Errorf("Head('%s', %q, %v): expected %q, got %q", test.json, test.path, test.n, test.exp, vals)
+			continue
+		}
+		for i := range vals {
+			if string(vals[i]) != test.exp[i] {
+				t.Errorf("Head('%s', %q, %v): expected %q, got %q", test.json, test.path, test.n, test.exp, vals)
+				break
+			}
+		}
+	}
+
+	// should not scan past the nth element
+	if vals := Head([]byte(`[1,2,{"unterminated":`), ``, 2); len(vals) != 2 {
+		t.Errorf("Head: expected 2 elements, got %q", vals)
+	}
+}
+
+func TestPathOf(t *testing.T) {
+	tests := []struct {
+		json  string
+		value string
+		path  string
+		ok    bool
+	}{
+		{`{"a":{"b":{"id":42}}}`, `42`, `a.b.id`, true},
+		{`{"a":[{"id":1},{"id":2}]}`, `2`, `a.1.id`, true},
+		{`{"a":[{"id":1},{"id":2}]}`, `{ "id" : 2 }`, `a.1`, true},
+		{`{"a":[1,2],"b":2}`, `2`, `a.1`, true},
+		{`{"a":{"x":[1]},"b":[1]}`, `[1]`, `a.x`, true},
+		{`{"a.b":{"c\\d":"v"}}`, `"v"`, `a\.b.c\\d`, true},
+		{`{"a":"x y"}`, `"xy"`, ``, false},
+		{`{"a":1}`, `{"a":1}`, ``, true},
+		{`{"a":1}`, `2`, ``, false},
+		{`{"a":1`, `1`, ``, false},
+		{``, `1`, ``, false},
+	}
+	for _, test := range tests {
+		if path, ok := PathOf([]byte(test.json), []byte(test.value)); path != test.path || ok != test.ok {
+			t.Errorf("PathOf('%s', '%s'): expected (%q, %v), got (%q, %v)", test.json, test.value, test.path, test.ok, path, ok)
+		}
+	}
+}
+
+func TestHasKey(t *testing.T) {
+	tests := []struct {
+		json string
+		key  string
+		has  bool
+	}{
+		{`{"a":1}`, `a`, true},
+		{`{"a":{"b":[{"c":{"d":1}}]}}`, `d`, true},
+		{`{"a":{"b":[{"c":{"d":1}}]}}`, `c`, true},
+		{`{"a":{"b":[{"c":{"d":1}}]}}`, `e`, false},
+		{`{"a":"d"}`, `d`, false},
+		{`[1,2]`, `0`, false},
+		{`{"ab":1}`, `ab`, true},
+		{`{"a\"b":1}`, `a"b`, true},
+		{`{"a":1`, `a`, false},
+		{``, `a`, false},
+	}
+	for _, test := range tests {
+		if has := HasKey([]byte(test.json), test.key); has != test.has {
+			t.Errorf("HasKey('%s', %q): expected %v, got %v", test.json, test.key, test.has, has)
+		}
+	}
+}
+
+func TestLeafValues(t *testing.T) {
+	json := []byte(`{"a":1,"b":["x",2.5,{"c":"y","d":[true,-3]}],"e":null,"f":"z"}`)
+	tests := []struct {
+		kind Kind
+		exp  []string
+	}{
+		{Number, []string{`1`, `2.5`, `-3`}},
+		{String, []string{`"x"`, `"y"`, `"z"`}},
+		{Bool, []string{`true`}},
+		{Null, []string{`null`}},
+		{Object, nil},
+		{Array, nil},
+	}
+	for _, test := range tests {
+		vals := LeafValues(json, test.kind)
+		if len(vals) != len(test.exp) {
+			t.Errorf("LeafValues(%v): expected %q, got %q", test.kind, test.exp, vals)
+			continue
+		}
+		for i := range vals {
+			if string(vals[i]) != test.exp[i] {
+				t.Errorf("LeafValues(%v): expected %q, got %q", test.kind, test.exp, vals)
+				break
+			}
+		}
+	}
+	if vals := LeafValues([]byte(` "foo" `), String); len(vals) != 1 || string(vals[0]) != `"foo"` {
+		t.Errorf("LeafValues: expected root string, got %q", vals)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		exp  []Member
+	}{
+		{`{"z":1,"a":[2],"m":{"x":3}}`, ``, []Member{{"z", []byte(`1`)}, {"a", []byte(`[2]`)}, {"m", []byte(`{"x":3}`)}}},
+		{`{"o":{"a\"b":1, "é":"x"}}`, `o`, []Member{{`a"b`, []byte(`1`)}, {"é", []byte(`"x"`)}}},
+		{`{"o":{}}`, `o`, []Member{}},
+		{`{"o":[1]}`, `o`, nil},
+		{`{"o":{}}`, `p`, nil},
+	}
+	for _, test := range tests {
+		members := Members([]byte(test.json), test.path)
+		if (members == nil) != (test.exp == nil) || len(members) != len(test.exp) {
+			t.Errorf("Members('%s', %q): expected %q, got %q", test.json, test.path, test.exp, members)
+			continue
+		}
+		for i := range members {
+			if members[i].Key != test.exp[i].Key || !bytes.Equal(members[i].Value, test.exp[i].Value) {
+				t.Errorf("Members('%s', %q): expected %q, got %q", test.json, test.path, test.exp, members)
+				break
+			}
+		}
+	}
+}
+
+func TestEntries(t *testing.T) {
+	tests := []struct {
+		json  string
+		exp   string
+		pairs string
+	}{
+		{`{"o":{"a":1,"b":"x"}}`, `[{"key":"a","value":1},{"key":"b","value":"x"}]`, `[["a",1],["b","x"]]`},
+		{`{"o":{ "a\"b" : [1, {"c":2}] }}`, `[{"key":"a\"b","value":[1, {"c":2}]}]`, `[["a\"b",[1, {"c":2}]]]`},
+		{`{"o":{}}`, `[]`, `[]`},
+		{`{"o":[1,2]}`, ``, ``},
+		{`{"p":{}}`, ``, ``},
+	}
+	for _, test := range tests {
+		if res := Entries([]byte(test.json), "o"); string(res) != test.exp {
+			t.Errorf("Entries(%q): expected %q, got %q", test.json, test.exp, res)
+		} else if test.exp == "" && res != nil {
+			t.Errorf("Entries(%q): expected nil, got %q", test.json, res)
+		}
+		if res := EntryPairs([]byte(test.json), "o"); string(res) != test.pairs {
+			t.Errorf("EntryPairs(%q): expected %q, got %q", test.json, test.pairs, res)
+		}
+	}
+}
+
+func TestFromEntries(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"e":[["a",1],["b","x"]]}`, `{"a":1,"b":"x"}`},
+		{`{"e":[{"key":"a","value":1},{"value":[1, 2],"key":"b"}]}`, `{"a":1,"b":[1, 2]}`},
+		{`{"e":[["a",1],{"key":"b","value":2}]}`, `{"a":1,"b":2}`},
+		{`{"e":[["a",1],["b",2],["a",3]]}`, `{"a":3,"b":2}`},
+		{`{"e":[["a\"b",{"c":null}]]}`, `{"a\"b":{"c":null}}`},
+		{`{"e":[]}`, `{}`},
+		{`{"e":[["a",1],["b"]]}`, ``},
+		{`{"e":[["a",1,2]]}`, ``},
+		{`{"e":[[1,1]]}`, ``},
+		{`{"e":[{"key":"a"}]}`, ``},
+		{`{"e":[1]}`, ``},
+		{`{"e":{}}`, ``},
+	}
+	for _, test := range tests {
+		if res := FromEntries([]byte(test.json), "e"); string(res) != test.exp {
+			t.Errorf("FromEntries(%q): expected %q, got %q", test.json, test.exp, res)
+		}
+	}
+
+	obj := `{"a":1,"b":{"c":[true]},"d\\e":"f"}`
+	if res := FromEntries(Entries([]byte(obj), ""), ""); string(res) != obj {
+		t.Errorf("FromEntries(Entries(%q)): got %q", obj, res)
+	}
+	if res := FromEntries(EntryPairs([]byte(obj), ""), ""); string(res) != obj {
+		t.Errorf("FromEntries(EntryPairs(%q)): got %q", obj, res)
+	}
+}
+
+func TestUnterminatedContainers(t *testing.T) {
+	obj := []byte(`{"a":{"b":1,"c":`)
+	arr := []byte(`{"a":[1,2`)
+	less := func(a, b []byte) bool { return string(a) < string(b) }
+	keep := func([]byte) bool { return false }
+
+	if res := Members(obj, "a"); res != nil {
+		t.Errorf("Members: expected nil, got %v", res)
+	}
+	if res := Entries(obj, "a"); res != nil {
+		t.Errorf("Entries: expected nil, got %q", res)
+	}
+	if res := EntryPairs(obj, "a"); res != nil {
+		t.Errorf("EntryPairs: expected nil, got %q", res)
+	}
+	if res := FromEntries([]byte(`{"a":[["k",1]`), "a"); res != nil {
+		t.Errorf("FromEntries: expected nil, got %q", res)
+	}
+	for name, fn := range map[string]func() []byte{
+		"InsertSorted":   func() []byte { return InsertSorted(arr, "a", []byte(`0`), less) },
+		"SetPair":        func() []byte { return SetPair(arr, "a", "k", 1) },
+		"FilterArray":    func() []byte { return FilterArray(arr, "a", keep) },
+		"SetSparse":      func() []byte { return SetSparse(arr, "a.5", 1) },
+		"AppendBatch":    func() []byte { return AppendBatch(arr, "a", []interface{}{1}) },
+		"EnsureContains": func() []byte { return EnsureContains(arr, "a", []byte(`3`)) },
+		"CoerceArray":    func() []byte { return CoerceArray(arr, "a", func(raw []byte) []byte { return raw }) },
+	} {
+		if res := fn(); string(res) != string(arr) {
+			t.Errorf("%v: expected original json, got %q", name, res)
+		}
+	}
+	for name, fn := range map[string]func() []byte{
+		"SetPrefixed":    func() []byte { return SetPrefixed(obj, "a", "b", 2) },
+		"SetPrefixedN":   func() []byte { return SetPrefixedN(obj, "a", "b", 2, 1) },
+		"SetBefore":      func() []byte { return SetBefore(obj, "a.d", "c", 2) },
+		"SetWhenSibling": func() []byte { return SetWhenSibling(obj, "a.b", "c", []byte(`1`), 2) },
+		"DropNulls":      func() []byte { return DropNulls(obj) },
+	} {
+		if res := fn(); string(res) != string(obj) {
+			t.Errorf("%v: expected original json, got %q", name, res)
+		}
+	}
+	if res := GetIndices(arr, "a", 0, 5); res[0] != nil || res[1] != nil {
+		t.Errorf("GetIndices: expected nil elements, got %q", res)
+	}
+	if res := Head(arr, "a", 5); res != nil {
+		t.Errorf("Head: expected nil, got %q", res)
+	}
+	if res := Slice(arr, "a", 0, 5); res != nil {
+		t.Errorf("Slice: expected nil, got %q", res)
+	}
+	if c := ArrayCursor([]byte(`[1,2`)); c != nil {
+		t.Errorf("ArrayCursor: expected nil, got %v elements", c.Len())
+	}
+	if _, _, ok := LocateMember(obj, "a.b"); ok {
+		t.Error("LocateMember: expected !ok")
+	}
+	if res := Get(obj, "a"); res != nil {
+		t.Errorf("Get: expected nil, got %q", res)
+	}
+	if res, _, ok := GetTyped(obj, "a"); ok {
+		t.Errorf("GetTyped: expected !ok, got %q", res)
+	}
+	if n := ValueSize(obj, "a"); n != -1 {
+		t.Errorf("ValueSize: expected -1, got %v", n)
+	}
+	// mismatched brackets pass a shallow termination check, but must not
+	// cause a panic
+	Stats([]byte(`{"a":[1,null}`))
+	Tokenize([]byte(`[{"a":1]`))
+	DropNulls([]byte(`{"a":[1,null}`))
+	if ops := Diff(obj, []byte(`{"a":{}}`)); ops != nil {
+		t.Errorf("Diff: expected nil, got %v", ops)
+	}
+	if EqualValue(obj, obj) {
+		t.Error("EqualValue: expected false")
+	}
+	GetResolved(obj, "a") // must not panic
+}
+
+func TestLocateMember(t *testing.T) {
+	json := `{"a":1, "b": {"c" : [1, 2], "d":"x"}, "e":[{"f":3}]}`
+	tests := []struct {
+		path   string
+		member string
+		ok     bool
+	}{
+		{`a`, `"a":1`, true},
+		{`b`, `"b": {"c" : [1, 2], "d":"x"}`, true},
+		{`b.c`, `"c" : [1, 2]`, true},
+		{`b.d`, `"d":"x"`, true},
+		{`e.0.f`, `"f":3`, true},
+		{`e.0`, ``, false},
+		{`b.c.1`, ``, false},
+		{`b.x`, ``, false},
+		{`x.a`, ``, false},
+		{``, ``, false},
+	}
+	for _, test := range tests {
+		start, end, ok := LocateMember([]byte(json), test.path)
+		if ok != test.ok || (ok && json[start:end] != test.member) {
+			t.Errorf("LocateMember(%q): expected ('%s', %v), got (%v, %v, %v)", test.path, test.member, test.ok, start, end, ok)
+		}
+	}
+}
+
+func TestReplaceInStrings(t *testing.T) {
+	tests := []struct {
+		json string
+		re   string
+		repl string
+		exp  string
+	}{
+		{`{"a":"foo bar","b":["foo",1,"baz"],"foo":"x"}`, `foo`, `qux`, `{"a":"qux bar","b":["qux",1,"baz"],"foo":"x"}`},
+		{`{"a":"v1.2","n":12}`, `(\d)`, `<$1>`, `{"a":"v<1>.<2>","n":12}`},
+		{`{"a":"x\ty","b":"x"}`, `x`, `"`, `{"a":"\"\ty","b":"\""}`},
+		{`{"a":"no match\/"}`, `z`, `y`, `{"a":"no match\/"}`},
+		{`"foo"`, `o+`, `0`, `"f0"`},
+		{`{"a":"foo"`, `foo`, `bar`, `{"a":"foo"`},
+		{``, `foo`, `bar`, ``},
+	}
+	for _, test := range tests {
+		if res := ReplaceInStrings([]byte(test.json), regexp.MustCompile(test.re), test.repl); string(res) != test.exp {
+			t.Errorf("ReplaceInStrings(%q, %q, %q): expected %q, got %q", test.json, test.re, test.repl, test.exp, res)
+		}
+	}
+}
+
+func TestReplaceInStringsAndKeys(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"foo":"foo","bar":{"food":[1,"foo"]}}`, `{"qux":"qux","bar":{"quxd":[1,"qux"]}}`},
+		{`{"a.foo":1}`, `{"a.qux":1}`},
+		{`["foo",{"x":"y"}]`, `["qux",{"x":"y"}]`},
+	}
+	re := regexp.MustCompile(`foo`)
+	for _, test := range tests {
+		if res := ReplaceInStringsAndKeys([]byte(test.json), re, "qux"); string(res) != test.exp {
+			t.Errorf("ReplaceInStringsAndKeys(%q): expected %q, got %q", test.json, test.exp, res)
+		}
+	}
+	// keys are still untouched by ReplaceInStrings
+	if res := ReplaceInStrings([]byte(`{"foo":"foo"}`), re, "qux"); string(res) != `{"foo":"qux"}` {
+		t.Errorf("ReplaceInStrings: expected keys to be untouched, got %q", res)
+	}
+	// a replaced key is re-escaped
+	if res := ReplaceInStringsAndKeys([]byte(`{"foo":1}`), re, `"`); string(res) != `{"\"":1}` {
+		t.Errorf("ReplaceInStringsAndKeys: expected escaped key, got %q", res)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  DocumentStats
+	}{
+		{`{"a":[1,"x",true,null,{"b":false,"c":2.5}],"d":{},"e":[]}`, DocumentStats{Objects: 3, Arrays: 2, Strings: 1, Numbers: 2, Booleans: 2, Nulls: 1}},
+		{`{}`, DocumentStats{Objects: 1}},
+		{` [ [], [[]] ] `, DocumentStats{Arrays: 4}},
+		{`-1`, DocumentStats{Numbers: 1}},
+		{`{"a":[1,2`, DocumentStats{}},
+		{``, DocumentStats{}},
+	}
+	for _, test := range tests {
+		if res := Stats([]byte(test.json)); res != test.exp {
+			t.Errorf("Stats(%q): expected %+v, got %+v", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  int
+	}{
+		{`{"a":1,"b":"x"}`, 1},
+		{`{"a":{"b":{"c":{"d":{}}}}}`, 5},
+		{`{"a":[1,{"b":[[]]}],"c":{}}`, 5},
+		{`[{}, [], {"a":[]}]`, 3},
+		{`{"a":"{[{[{["}`, 1},
+		{`{"a":"\"{"}`, 1},
+		{`"{}"`, 0},
+		{` 12 `, 0},
+		{`{"a":[1`, 0},
+		{``, 0},
+	}
+	for _, test := range tests {
+		if res := MaxDepth([]byte(test.json)); res != test.exp {
+			t.Errorf("MaxDepth(%q): expected %v, got %v", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	json := []byte(` {"a": [1, "x\"y"], "b" :{"c":true,"d":null}, "e":[]} `)
+	exp := []Token{
+		{TokenObjectStart, 1, []byte(`{`)},
+		{TokenKey, 2, []byte(`"a"`)},
+		{TokenArrayStart, 7, []byte(`[`)},
+		{TokenNumber, 8, []byte(`1`)},
+		{TokenString, 11, []byte(`"x\"y"`)},
+		{TokenArrayEnd, 17, []byte(`]`)},
+		{TokenKey, 20, []byte(`"b"`)},
+		{TokenObjectStart, 25, []byte(`{`)},
+		{TokenKey, 26, []byte(`"c"`)},
+		{TokenBool, 30, []byte(`true`)},
+		{TokenKey, 35, []byte(`"d"`)},
+		{TokenNull, 39, []byte(`null`)},
+		{TokenObjectEnd, 43, []byte(`}`)},
+		{TokenKey, 46, []byte(`"e"`)},
+		{TokenArrayStart, 50, []byte(`[`)},
+		{TokenArrayEnd, 51, []byte(`]`)},
+		{TokenObjectEnd, 52, []byte(`}`)},
+	}
+	toks := Tokenize(json)
+	if len(toks) != len(exp) {
+		t.Fatalf("Tokenize: expected %v tokens, got %v", len(exp), len(toks))
+	}
+	for i := range toks {
+		if toks[i].Kind != exp[i].Kind || toks[i].Offset != exp[i].Offset || string(toks[i].Raw) != string(exp[i].Raw) {
+			t.Errorf("Tokenize: expected token %v to be %v, got %v", i, exp[i], toks[i])
+		}
+		if tok := toks[i]; string(json[tok.Offset:tok.Offset+len(tok.Raw)]) != string(tok.Raw) {
+			t.Errorf("Tokenize: token %v has wrong offset", i)
+		}
+	}
+
+	if toks := Tokenize([]byte(`-1.5`)); len(toks) != 1 || toks[0].Kind != TokenNumber || string(toks[0].Raw) != `-1.5` {
+		t.Errorf("Tokenize: unexpected tokens for scalar: %v", toks)
+	}
+	for _, json := range []string{``, ` `, `{"a":[1`} {
+		if toks := Tokenize([]byte(json)); toks != nil {
+			t.Errorf("Tokenize(%q): expected nil, got %v", json, toks)
+		}
+	}
+}
+
+func TestSetAllLeaves(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"a":1,"b":["x",2.5,{"c":null,"d":[true,[]]}],"e":{}}`, `{"a":"x","b":["x","x",{"c":"x","d":["x",[]]}],"e":{}}`},
+		{`{ "a" : 1 ,"b": [ 2 ] }`, `{ "a" : "x" ,"b": [ "x" ] }`},
+		{`"y"`, `"x"`},
+		{`[]`, `[]`},
+		{`[1`, `[1`},
+		{``, ``},
+	}
+	for _, test := range tests {
+		if res := SetAllLeaves([]byte(test.json), "x"); string(res) != test.exp {
+			t.Errorf("SetAllLeaves('%s'): expected '%s', got '%s'", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestIndexOffset(t *testing.T) {
+	json := []byte(`{"a":[10, "x" ,{"b":2}]}`)
+	tests := []struct {
+		path  string
+		index int
+		exp   int
+	}{
+		{"a", 0, 6},
+		{"a", 1, 10},
+		{"a", 2, 15},
+		{"a", 3, 22},
+		{"a", 4, -1},
+		{"a", -1, -1},
+		{"a.2", 0, -1},
+		{"x", 0, -1},
+	}
+	for _, test := range tests {
+		if res := IndexOffset(json, test.path, test.index); res != test.exp {
+			t.Errorf("IndexOffset(%q, %v): expected %v, got %v", test.path, test.index, test.exp, res)
+		}
+	}
+	if res := IndexOffset([]byte(` [ ] `), "", 0); res != 3 {
+		t.Errorf("IndexOffset: expected 3, got %v", res)
+	}
+	if res := IndexOffset([]byte(`{"a":null}`), "a", 0); res != -1 {
+		t.Errorf("IndexOffset: expected -1, got %v", res)
+	}
+}
+
+func TestGetIndices(t *testing.T) {
+	tests := []struct {
+		json    string
+		path    string
+		indices []int
+		exp     []string
+	}{
+		{`[0, 1, 2, 3, 4]`, ``, []int{3, 0, 1}, []string{`3`, `0`, `1`}},
+		{`{"foo":[0, "1", [2], {"3":3}]}`, `foo`, []int{3, 7, 2}, []string{`{"3":3}`, ``, `[2]`}},
+		{`[0, 1]`, ``, []int{1, 1, -1}, []string{`1`, `1`, ``}},
+		{`[0, 1]`, ``, nil, nil},
+		{`[]`, ``, []int{0}, []string{``}},
+		// non-arrays
+		{`{"foo":{"0":0}}`, `foo`, []int{0}, []string{``}},
+		{`{"foo":[0]}`, `bar`, []int{0}, []string{``}},
+	}
+	for _, test := range tests {
+		res := GetIndices([]byte(test.json), test.path, test.indices...)
+		if len(res) != len(test.exp) {
+			t.Errorf("GetIndices('%s', %q, %v): expected %v values, got %v", test.json, test.path, test.indices, len(test.exp), len(res))
+			continue
+		}
+		for i := range res {
+			if string(res[i]) != test.exp[i] {
+				t.Errorf("GetIndices('%s', %q, %v): expected '%s' at %v, got '%s'", test.json, test.path, test.indices, test.exp[i], i, res[i])
+			}
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		json string
+		ops  []Op
+		exp  string
+	}{
+		{`{"a":1,"b":2}`, nil, `{"a":1,"b":2}`},
+		{`{"a":1,"b":2}`, []Op{{"a", []byte(`3`)}, {"b", []byte(`4`)}}, `{"a":3,"b":4}`},
+		{`{"a":1,"b":2}`, []Op{{"b", []byte(`4`)}, {"a", []byte(`3`)}}, `{"a":3,"b":4}`},
+		{`{"a":1}`, []Op{{"a", []byte(`3`)}, {"b", []byte(`4`)}}, `{"a":3,"b":4}`},
+		{`{"a":null,"b":[]}`, []Op{{"a.0", []byte(`1`)}, {"b.0", []byte(`2`)}}, `{"a":[1],"b":[2]}`},
+		// sequential fallbacks
+		{`{}`, []Op{{"a", []byte(`1`)}, {"b", []byte(`2`)}}, `{"a":1,"b":2}`},
+		{`{}`, []Op{{"a", []byte(`{}`)}, {"a.b", []byte(`2`)}}, `{"a":{"b":2}}`},
+		{`{"a":1}`, []Op{{"a", []byte(`2`)}, {"a", []byte(`3`)}}, `{"a":3}`},
+		{`{"a":{"b":1}}`, []Op{{"a.b", []byte(`2`)}, {"a", []byte(`3`)}}, `{"a":3}`},
+		{`{"a":1}`, []Op{{"a.b", []byte(`2`)}, {"a", []byte(`3`)}}, `{"a":3}`},
+		{`{"a":1}`, []Op{{"", []byte(`[]`)}}, `[]`},
+	}
+	for _, test := range tests {
+		json := []byte(test.json)
+		if res := Apply(json, test.ops); string(res) != test.exp {
+			t.Errorf("Apply('%s', %q): expected '%s', got '%s'", test.json, test.ops, test.exp, res)
+		} else if string(json) != test.json {
+			t.Errorf("Apply('%s', %q): modified original json", test.json, test.ops)
+		}
+		if res := ApplyInPlace([]byte(test.json), test.ops); string(res) != test.exp {
+			t.Errorf("ApplyInPlace('%s', %q): expected '%s', got '%s'", test.json, test.ops, test.exp, res)
+		}
+	}
+
+	// shrinking edits should be written in place, without padding
+	json := []byte(`{"a":"xxxx","b":[1,2,3],"c":"yyyy"}`)
+	res := ApplyInPlace(json, []Op{{"c", []byte(`"y"`)}, {"a", []byte(`"x"`)}, {"b", []byte(`[]`)}, {"d", []byte(`4`)}})
+	if exp := `{"a":"x","b":[],"c":"y","d":4}`; string(res) != exp {
+		t.Errorf("ApplyInPlace: expected '%s', got '%s'", exp, res)
+	} else if &res[0] != &json[0] {
+		t.Error("ApplyInPlace: shrinking edits should not allocate")
+	}
+}
+
+// countdownCtx is a context that is canceled after Err has been called n
+// times.
+type countdownCtx struct {
+	context.Context
+	n int
+}
+
+func (c *countdownCtx) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestInPlaceEligible(t *testing.T) {
+	tests := []struct {
+		json string
+		ops  []Op
+		exp  bool
+	}{
+		{`{"a":100,"b":"xyz"}`, []Op{{"a", []byte(`1`)}, {"b", []byte(`""`)}}, true},
+		{`{"a":100,"b":"xyz"}`, []Op{{"a", []byte(`999`)}, {"b", []byte(`"abc"`)}}, true},
+		{`{"a":100,"b":"xyz"}`, []Op{{"a", []byte(`1000`)}}, false},
+		{`{"a":100,"b":"xyz"}`, []Op{{"a", []byte(`1`)}, {"b", []byte(`"wxyz"`)}}, true},
+		{`{"a":100,"b":"xyz"}`, []Op{{"a", []byte(`1000`)}, {"b", []byte(`""`)}}, false},
+		{`{"a":100,"b":"xyz"}`, []Op{{"c", []byte(`1`)}}, false},
+		{`{"a":100,"b":"xyz"}`, []Op{{"a", []byte(`1`)}, {"a", []byte(`2`)}}, false},
+		{`{"a":100}`, []Op{{"x.y", []byte(`1`)}}, false},
+		{`{"a":100}`, nil, true},
+	}
+	for _, test := range tests {
+		if res := InPlaceEligible([]byte(test.json), test.ops); res != test.exp {
+			t.Errorf("InPlaceEligible(%q, %v ops): expected %v, got %v", test.json, len(test.ops), test.exp, res)
+		}
+		if test.exp {
+			json := []byte(test.json)
+			if res := ApplyInPlace(json, test.ops); len(res) > 0 && &res[0] != &json[0] {
+				t.Errorf("InPlaceEligible(%q, %v ops): ApplyInPlace allocated", test.json, len(test.ops))
+			}
+		}
+	}
+}
+
+func TestApplyContext(t *testing.T) {
+	json := []byte(`{"a":0}`)
+	ops := make([]Op, 1000)
+	for i := range ops {
+		ops[i] = Op{"a", []byte(strconv.Itoa(i + 1))}
+	}
+	res, err := ApplyContext(context.Background(), json, ops)
+	if err != nil || string(res) != `{"a":1000}` {
+		t.Errorf("ApplyContext: expected '{\"a\":1000}', got ('%s', %v)", res, err)
+	}
+
+	// cancel partway through
+	ctx := &countdownCtx{context.Background(), 3}
+	res, err = ApplyContext(ctx, json, ops)
+	if err != context.Canceled || string(res) != `{"a":0}` {
+		t.Errorf("ApplyContext: expected original json and context.Canceled, got ('%s', %v)", res, err)
+	} else if string(json) != `{"a":0}` {
+		t.Errorf("ApplyContext: modified original json: '%s'", json)
+	}
+
+	// cancel before starting
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if res, err := ApplyContext(canceled, json, ops); err != context.Canceled || string(res) != `{"a":0}` {
+		t.Errorf("ApplyContext: expected original json and context.Canceled, got ('%s', %v)", res, err)
+	}
+}
+
+func TestDiffPath(t *testing.T) {
+	tests := []struct {
+		a, b string
+		path string
+		exp  []Op
+	}{
+		{`{"x":{"a":1,"b":[1,2]},"y":1}`, `{"x":{"a":2,"b":[1,3]},"y":2}`, "x", []Op{{"x.a", []byte(`2`)}, {"x.b.1", []byte(`3`)}}},
+		{`{"x":{"a":1}}`, `{"x":{"a":1,"b.c":true}}`, "x", []Op{{`x.b\.c`, []byte(`true`)}}},
+		{`{"x":{"a":1,"b":2}}`, `{"x":{"a":1}}`, "x", []Op{{"x", []byte(`{"a":1}`)}}},
+		{`{"x":[1,2]}`, `{"x":[1,2,3]}`, "x", []Op{{"x", []byte(`[1,2,3]`)}}},
+		{`{"x":{"a": [1, 2]}}`, `{"x":{"a":[1,2]}}`, "x", nil},
+		{`{"x":1}`, `{"x":"1"}`, "x", []Op{{"x", []byte(`"1"`)}}},
+		{`{}`, `{"x":{"a":1}}`, "x", []Op{{"x", []byte(`{"a":1}`)}}},
+		{`{"x":1}`, `{}`, "x", nil},
+		{`{"a":1,"b":[true]}`, `{"a":1,"b":[false]}`, "", []Op{{"b.0", []byte(`false`)}}},
+	}
+	for _, test := range tests {
+		ops := DiffPath([]byte(test.a), []byte(test.b), test.path)
+		if len(ops) != len(test.exp) {
+			t.Errorf("DiffPath(%q, %q, %q): expected %v ops, got %v", test.a, test.b, test.path, len(test.exp), len(ops))
+			continue
+		}
+		for i := range ops {
+			if ops[i].Path != test.exp[i].Path || string(ops[i].Value) != string(test.exp[i].Value) {
+				t.Errorf("DiffPath(%q, %q, %q): expected op %v to be {%q %s}, got {%q %s}", test.a, test.b, test.path, i, test.exp[i].Path, test.exp[i].Value, ops[i].Path, ops[i].Value)
+			}
+		}
+		if len(ops) > 0 {
+			res := Apply([]byte(test.a), ops)
+			if got, want := Get(res, test.path), Get([]byte(test.b), test.path); string(appendCompact(nil, got)) != string(appendCompact(nil, want)) {
+				t.Errorf("DiffPath(%q, %q, %q): applying ops yielded %s", test.a, test.b, test.path, res)
+			}
+		}
+	}
+
+	a, b := `{"a":{"b":[1,{"c":null}]},"d":"e"}`, `{"a":{"b":[1,{"c":"x"}]},"d":"f"}`
+	if res := Apply([]byte(a), Diff([]byte(a), []byte(b))); string(res) != b {
+		t.Errorf("Diff: expected %s, got %s", b, res)
+	}
+}
+
+func TestDropNulls(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{``, ``},
+		{`null`, `null`},
+		{`{}`, `{}`},
+		{`{"a":null}`, `{}`},
+		{`{"a": null, "b": 1}`, `{"b": 1}`},
+		{`{"b": 1, "a": null}`, `{"b": 1}`},
+		{`{"a":null,"b":null,"c":1,"d":null,"e":null}`, `{"c":1}`},
+		{`{"a":1,"b":null,"c":2,"d":null,"e":3}`, `{"a":1,"c":2,"e":3}`},
+		{`{"a":{"b":null,"c":{"d":null}},"e":null}`, `{"a":{"c":{}}}`},
+		{`[null, {"a":null,"b":[null]}, null]`, `[null, {"b":[null]}, null]`},
+		{`{"a":[{"b":null}],"c":"null"}`, `{"a":[{}],"c":"null"}`},
+	}
+	for _, test := range tests {
+		if res := DropNulls([]byte(test.json)); string(res) != test.exp {
+			t.Errorf("DropNulls('%s'): expected '%s', got '%s'", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestSlice(t *testing.T) {
+	tests := []struct {
+		json       string
+		path       string
+		start, end int
+		exp        string
+	}{
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, 1, 3, `[1, 2]`},
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, 3, 10, `[3, 4]`},
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, -2, 2, `[0, 1]`},
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, 0, 5, `[0, 1, 2, 3, 4]`},
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, 2, 2, `[]`},
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, 3, 1, `[]`},
+		{`{"a":[0, 1, 2, 3, 4]}`, `a`, 5, 7, `[]`},
+		{`{"a":[]}`, `a`, 0, 1, `[]`},
+		{`[{"b":[1]},"c"]`, ``, 0, 1, `[{"b":[1]}]`},
+		{`{"a":{}}`, `a`, 0, 1, ``},
+		{`{"a":[]}`, `b`, 0, 1, ``},
+	}
+	for _, test := range tests {
+		res := Slice([]byte(test.json), test.path, test.start, test.end)
+		if string(res) != test.exp || (res == nil) != (test.exp == "") {
+			t.Errorf("Slice('%s', %q, %v, %v): expected '%s', got '%s'", test.json, test.path, test.start, test.end, test.exp, res)
+		}
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	objs := []interface{}{1, "two", map[string]int{"three": 3}}
+	tests := []struct {
+		json string
+		objs []interface{}
+		exp  string
+	}{
+		{`{"a":[]}`, objs, `{"a":[1,"two",{"three":3}]}`},
+		{`{"a":[0]}`, objs, `{"a":[0,1,"two",{"three":3}]}`},
+		{`{"a":[ 0 ],"b":1}`, objs[:1], `{"a":[ 0 ,1],"b":1}`},
+		{`{"a":null}`, objs, `{"a":[1,"two",{"three":3}]}`},
+		{`{"a":[0]}`, nil, `{"a":[0]}`},
+		{`{"a":{}}`, objs, `{"a":{}}`},
+		{`{"b":[]}`, objs, `{"b":[]}`},
+	}
+	for _, test := range tests {
+		if res := AppendBatch([]byte(test.json), "a", test.objs); string(res) != test.exp {
+			t.Errorf("AppendBatch(%q, %v): expected %q, got %q", test.json, test.objs, test.exp, res)
+		}
+	}
+}
+
+func TestMergeArray(t *testing.T) {
+	tests := []struct {
+		dst       string
+		src       string
+		exp       string
+		skipNulls string
+	}{
+		{`{"a":[1,2,3]}`, `[9,8]`, `{"a":[9,8,3]}`, `{"a":[9,8,3]}`},
+		{`{"a":[1,2]}`, `[9,8,7,6]`, `{"a":[9,8,7,6]}`, `{"a":[9,8,7,6]}`},
+		{`{"a":[1, 2, 3]}`, `[null, {"b":1}]`, `{"a":[null, {"b":1}, 3]}`, `{"a":[1, {"b":1}, 3]}`},
+		{`{"a":[1]}`, `[null,null,5]`, `{"a":[null,null,5]}`, `{"a":[1,null,5]}`},
+		{`{"a":[]}`, `[1,2]`, `{"a":[1,2]}`, `{"a":[1,2]}`},
+		{`{"a":[ ]}`, `[1]`, `{"a":[ 1]}`, `{"a":[ 1]}`},
+		{`{"a":[1,2]}`, `[]`, `{"a":[1,2]}`, `{"a":[1,2]}`},
+		{`{"a":[1,2]}`, `{"0":3}`, `{"a":[1,2]}`, `{"a":[1,2]}`},
+		{`{"a":{}}`, `[1]`, `{"a":{}}`, `{"a":{}}`},
+	}
+	for _, test := range tests {
+		if res := MergeArray([]byte(test.dst), "a", []byte(test.src)); string(res) != test.exp {
+			t.Errorf("MergeArray(%q, %q): expected %q, got %q", test.dst, test.src, test.exp, res)
+		}
+		if res := MergeArraySkipNulls([]byte(test.dst), "a", []byte(test.src)); string(res) != test.skipNulls {
+			t.Errorf("MergeArraySkipNulls(%q, %q): expected %q, got %q", test.dst, test.src, test.skipNulls, res)
+		}
+	}
+}
+
+func TestInsertSorted(t *testing.T) {
+	less := func(a, b []byte) bool {
+		x, _ := strconv.Atoi(string(a))
+		y, _ := strconv.Atoi(string(b))
+		return x < y
+	}
+	tests := []struct {
+		json  string
+		value string
+		exp   string
+	}{
+		{`{"a":[1,3,5]}`, `4`, `{"a":[1,3,4,5]}`},
+		{`{"a":[1,3,5]}`, `0`, `{"a":[0,1,3,5]}`},
+		{`{"a":[1,3,5]}`, `9`, `{"a":[1,3,5,9]}`},
+		{`{"a":[1,3,5]}`, `3`, `{"a":[1,3,3,5]}`},
+		{`{"a":[1, 3, 5]}`, `2`, `{"a":[1, 2, 3, 5]}`},
+		{`{"a":[]}`, `2`, `{"a":[2]}`},
+		{`{"a":null}`, `2`, `{"a":[2]}`},
+		{`{"a":{}}`, `2`, `{"a":{}}`},
+	}
+	for _, test := range tests {
+		if res := InsertSorted([]byte(test.json), "a", []byte(test.value), less); string(res) != test.exp {
+			t.Errorf("InsertSorted('%s', '%s'): expected '%s', got '%s'", test.json, test.value, test.exp, res)
+		}
+	}
+}
+
+func TestCoerceArray(t *testing.T) {
+	unquote := func(raw []byte) []byte {
+		if len(raw) >= 2 && raw[0] == '"' {
+			if _, err := strconv.ParseFloat(string(raw[1:len(raw)-1]), 64); err == nil {
+				return raw[1 : len(raw)-1]
+			}
+		}
+		return raw
+	}
+	tests := []struct {
+		json string
+		path string
+		fn   func([]byte) []byte
+		exp  string
+	}{
+		{`{"a":["1", "22", "x", 3, "4.5"]}`, `a`, unquote, `{"a":[1, 22, "x", 3, 4.5]}`},
+		{`{"a":[1,2,3]}`, `a`, func([]byte) []byte { return []byte(`"long"`) }, `{"a":["long","long","long"]}`},
+		{`{"a":[[1],{"b":2}],"c":1}`, `a`, func([]byte) []byte { return []byte(`0`) }, `{"a":[0,0],"c":1}`},
+		{`{"a":[]}`, `a`, unquote, `{"a":[]}`},
+		{`{"a":{"b":"1"}}`, `a`, unquote, `{"a":{"b":"1"}}`},
+		{`{"a":"1"}`, `b`, unquote, `{"a":"1"}`},
+	}
+	for _, test := range tests {
+		res := CoerceArray([]byte(test.json), test.path, test.fn)
+		if string(res) != test.exp {
+			t.Errorf("CoerceArray('%s', %q): expected '%s', got '%s'", test.json, test.path, test.exp, res)
+		} else if err := Validate(res); err != nil {
+			t.Errorf("CoerceArray('%s', %q): invalid result: %v", test.json, test.path, err)
+		}
+	}
+}
+
+func TestEnsureContains(t *testing.T) {
+	tests := []struct {
+		json  string
+		path  string
+		value string
+		exp   string
+	}{
+		{`{"tags":["a","b"]}`, `tags`, `"c"`, `{"tags":["a","b","c"]}`},
+		{`{"tags":["a","b"]}`, `tags`, `"b"`, `{"tags":["a","b"]}`},
+		{`{"tags":[{"a": 1}]}`, `tags`, `{"a":1}`, `{"tags":[{"a": 1}]}`},
+		{`{"tags":[ ]}`, `tags`, `"a"`, `{"tags":[ "a"]}`},
+		{`{"tags":[]}`, `tags`, `"a"`, `{"tags":["a"]}`},
+		{`{"tags":null}`, `tags`, `"a"`, `{"tags":["a"]}`},
+		{`{"tags":"a"}`, `tags`, `"a"`, `{"tags":"a"}`},
+		{`{"tags":[]}`, `other`, `"a"`, `{"tags":[]}`},
+		{`[1,2]`, ``, `3`, `[1,2,3]`},
+	}
+	for _, test := range tests {
+		if res := EnsureContains([]byte(test.json), test.path, []byte(test.value)); string(res) != test.exp {
+			t.Errorf("EnsureContains('%s', %q, '%s'): expected '%s', got '%s'", test.json, test.path, test.value, test.exp, res)
+		}
+	}
+}
+
+func TestFilterArray(t *testing.T) {
+	atLeast3 := func(raw []byte) bool {
+		n, err := strconv.Atoi(string(raw))
+		return err == nil && n >= 3
+	}
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"a":[1,5,2,3,0]}`, `{"a":[5,3]}`},
+		{`{"a":[1,2,3]}`, `{"a":[3]}`},
+		{`{"a":[3,4,1,2]}`, `{"a":[3,4]}`},
+		{`{"a":[ 4, 1, 9 ]}`, `{"a":[ 4, 9 ]}`},
+		{`{"a":[1,2]}`, `{"a":[]}`},
+		{`{"a":[3,"x",{"b":1}]}`, `{"a":[3]}`},
+		{`{"a":[]}`, `{"a":[]}`},
+		{`{"a":{"b":1}}`, `{"a":{"b":1}}`},
+	}
+	for _, test := range tests {
+		if res := FilterArray([]byte(test.json), "a", atLeast3); string(res) != test.exp {
+			t.Errorf("FilterArray(%q): expected %q, got %q", test.json, test.exp, res)
+		}
+	}
+}
+
+func TestSetPair(t *testing.T) {
+	tests := []struct {
+		json string
+		key  string
+		obj  interface{}
+		exp  string
+	}{
+		{`{"m":[["a",1],["b",2]]}`, "b", 3, `{"m":[["a",1],["b",3]]}`},
+		{`{"m":[["a",1],["b",2]]}`, "a", "x", `{"m":[["a","x"],["b",2]]}`},
+		{`{"m":[["a",1],["b",2]]}`, "c", true, `{"m":[["a",1],["b",2],["c",true]]}`},
+		{`{"m":[ ["a", 1] ]}`, "a", 2, `{"m":[ ["a", 2] ]}`},
+		{`{"m":[["a"]]}`, "a", 1, `{"m":[["a",1]]}`},
+		{`{"m":[["ab",1]]}`, "ab", 2, `{"m":[["ab",2]]}`},
+		{`{"m":[[],1,["1",0]]}`, "1", 2, `{"m":[[],1,["1",2]]}`},
+		{`{"m":[]}`, "a", 1, `{"m":[["a",1]]}`},
+		{`{"m":null}`, "a", 1, `{"m":[["a",1]]}`},
+		{`{"m":{}}`, "a", 1, `{"m":{}}`},
+	}
+	for _, test := range tests {
+		if res := SetPair([]byte(test.json), "m", test.key, test.obj); string(res) != test.exp {
+			t.Errorf("SetPair(%q, %q, %v): expected %q, got %q", test.json, test.key, test.obj, test.exp, res)
+		}
+	}
+}
+
+func TestAppendToString(t *testing.T) {
+	tests := []struct {
+		json   string
+		path   string
+		suffix string
+		exp    string
+	}{
+		{`""`, ``, "foo", `"foo"`},
+		{`{"foo":""}`, `foo`, "bar", `{"foo":"bar"}`},
+		{`{"foo":"bar"}`, `foo`, "baz", `{"foo":"barbaz"}`},
+		{`{"foo":"a\"b\\"}`, `foo`, "c", `{"foo":"a\"b\\c"}`},
+		{`{"foo":"bar"}`, `foo`, `"baz"`, `{"foo":"bar\"baz\""}`},
+		{`{"foo":"bar"}`, `foo`, "a\nb", `{"foo":"bara\nb"}`},
+		{`[1, "foo"]`, `1`, "bar", `[1, "foobar"]`},
+		// non-strings
+		{`{"foo":3}`, `foo`, "bar", `{"foo":3}`},
+		{`{"foo":null}`, `foo`, "bar", `{"foo":null}`},
+		{`{"foo":["bar"]}`, `foo`, "baz", `{"foo":["bar"]}`},
+		{`{"foo":"bar"}`, `bar`, "baz", `{"foo":"bar"}`},
+		// unterminated strings
+		{`{"a":"abc`, `a`, "X", `{"a":"abc`},
+		{`"abc`, ``, "X", `"abc`},
+		{`"abc\"`, ``, "X", `"abc\"`},
+	}
+	for _, test := range tests {
+		if res := AppendToString([]byte(test.json), test.path, test.suffix); string(res) != test.exp {
+			t.Errorf("AppendToString('%s', %q, %q): expected '%s', got '%s'", test.json, test.path, test.suffix, test.exp, res)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		exp  []string
+	}{
+		{``, nil},
+		{`foo`, []string{"foo"}},
+		{`foo.bar.0`, []string{"foo", "bar", "0"}},
+		{`foo\.bar.baz`, []string{"foo.bar", "baz"}},
+		{`a\\.b`, []string{`a\`, "b"}},
+		{`"a.b".c`, []string{"a.b", "c"}},
+		{`a."b.c"`, []string{"a", "b.c"}},
+		{`a.#(name=x.y).b`, []string{"a", "#(name=x.y)", "b"}},
+		{`a.-`, []string{"a", "-"}},
+	}
+	for _, test := range tests {
+		accs, err := ParsePath(test.path)
+		if err != nil {
+			t.Errorf("ParsePath(%q): unexpected error: %v", test.path, err)
+		} else if strings.Join(accs, "|") != strings.Join(test.exp, "|") || len(accs) != len(test.exp) {
+			t.Errorf("ParsePath(%q): expected %q, got %q", test.path, test.exp, accs)
+		}
+	}
+	for _, path := range []string{`foo..bar`, `foo.`, `foo\`, `"foo`, `"foo"bar`, `a.*`} {
+		if _, err := ParsePath(path); err == nil {
+			t.Errorf("ParsePath(%q): expected error", path)
+		}
+	}
+}
+
+func TestValidPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{``, true},
+		{`a`, true},
+		{`a.b.0`, true},
+		{`{}.a`, true},
+		{`a..b`, false},
+		{`a.`, false},
+		{`.a`, false},
+		{`a.*`, false},
+		{`a.b?`, false},
+		{`a|b`, false},
+		{`a.#`, false},
+		{`a.@reverse`, false},
+		{`a.#(id=1).b`, true},
+		{`a.#(id=1.5)`, true},
+		{`a.#(id)`, false},
+		{`a.#(=1)`, false},
+		{`a.#(id=1`, false},
+		{`a.#(id=1)x`, false},
+		{`"a.b".c`, true},
+		{`a."b.c"`, true},
+		{`a."*#".c`, true},
+		{`""`, true},
+		{`a."b\"c"`, true},
+		{`a."b`, false},
+		{`a."b\"`, false},
+		{`a."b"c`, false},
+		{`a.b"c"`, true},
+		{`a\.b`, true},
+		{`a\*`, true},
+		{`a\\.b`, true},
+		{`a\`, false},
+		{`a\\\`, false},
+		{`a\.b\`, false},
+	}
+	for _, test := range tests {
+		if err := ValidPath(test.path); (err == nil) != test.valid {
+			t.Errorf("ValidPath(%q): expected valid=%v, got %v", test.path, test.valid, err)
+		}
+	}
+}
+
+func TestNextAccessor(t *testing.T) {
+	tests := []struct {
+		path string
+		acc  string
+		rest string
+		last bool
+	}{
+		{``, ``, ``, true},
+		{`foo`, `foo`, ``, true},
+		{`foo.bar.baz`, `foo`, `bar.baz`, false},
+		{`foo\.bar.baz`, `foo.bar`, `baz`, false},
+		{`foo\.bar`, `foo.bar`, ``, true},
+		{`foo\\.bar`, `foo\`, `bar`, false},
+		{`foo\\\.bar`, `foo\.bar`, ``, true},
+		{`\f\o\o`, `foo`, ``, true},
+		{`foo\`, `foo\`, ``, true},
+		{`.foo`, ``, `foo`, false},
+		{`#(a.b=1).c`, `#(a.b=1)`, `c`, false},
+		{`#(a=1.5)`, `#(a=1.5)`, ``, true},
+		{`#(a=1.5`, `#(a=1`, `5`, false},
+		{`"a.b".c`, `a.b`, `c`, false},
+		{`"a.b"`, `a.b`, ``, true},
+		{`"a\".b".c`, `a".b`, `c`, false},
+		{`"a\\".b`, `a\`, `b`, false},
+		{`""`, ``, ``, true},
+		{`\"a".b`, `"a"`, `b`, false},
+		{`a"b.c"`, `a"b`, `c"`, false},
+		{`"a.b`, `"a`, `b`, false},
+	}
+	for _, test := range tests {
+		if acc, rest, last := nextAccessor(test.path); acc != test.acc || rest != test.rest || last != test.last {
+			t.Errorf("nextAccessor(%q): expected (%q, %q, %v), got (%q, %q, %v)", test.path, test.acc, test.rest, test.last, acc, rest, last)
+		}
+	}
+}
+
+func TestQueryAccessor(t *testing.T) {
+	tests := []struct {
+		json string
+		path string
+		val  interface{}
+		exp  string
+	}{
+		{`{"items":[{"id":41,"name":"a"},{"id":42,"name":"b"}]}`, `items.#(id=42).name`, "c", `{"items":[{"id":41,"name":"a"},{"id":42,"name":"c"}]}`},
+		{`{"items":[{"id":42,"name":"a"},{"id":42,"name":"b"}]}`, `items.#(id=42).name`, "c", `{"items":[{"id":42,"name":"c"},{"id":42,"name":"b"}]}`},
+		{`{"items":[{"id":41},{"id":42}]}`, `items.#(id=42).name`, "c", `{"items":[{"id":41},{"id":42,"name":"c"}]}`},
+		{`{"items":[{"id":41},{"id":42}]}`, `items.#(id=42)`, 0, `{"items":[{"id":41},0]}`},
+		{`{"items":[1,{"k":"x y"}]}`, `items.#(k=x y).k`, "z", `{"items":[1,{"k":"z"}]}`},
+		{`{"items":[{"k":"x"}]}`, `items.#(k="x").k`, "z", `{"items":[{"k":"z"}]}`},
+		{`{"items":[{"k":{"a":1}}]}`, `items.#(k={"a": 1}).k`, 2, `{"items":[{"k":2}]}`},
+		{`{"items":[{"a.b":1}]}`, `items.#(a.b=1).c`, 2, `{"items":[{"a.b":1,"c":2}]}`},
+		// no match
+		{`{"items":[{"id":41},{"id":42}]}`, `items.#(id=43).name`, "c", `{"items":[{"id":41},{"id":42}]}`},
+		{`{"items":[{"id":41},{"id":42}]}`, `items.#(id=43)`, "c", `{"items":[{"id":41},{"id":42}]}`},
+		{`{"items":[]}`, `items.#(id=1).name`, "c", `{"items":[]}`},
+		{`{"items":{"id":42}}`, `items.#(id=42).name`, "c", `{"items":{"id":42}}`},
+		{`{"#(id=42)":{"name":"b"}}`, `#(id=42).name`, "c", `{"#(id=42)":{"name":"c"}}`},
 	}
 	for _, test := range tests {
-		if res := SetInPlace([]byte(test.json), test.path, test.val); string(res) != test.exp {
-			t.Errorf("SetInPlace('%s', %q, '%s'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		if res := Set([]byte(test.json), test.path, test.val); string(res) != test.exp {
+			t.Errorf("Set('%s', %q, '%v'): expected '%s', got '%s'", test.json, test.path, test.val, test.exp, res)
+		}
+	}
+}
+
+func TestEscapedPath(t *testing.T) {
+	json := []byte(`{"foo.bar":{"baz\\":1},"foo":{"bar":2}}`)
+	if res := Get(json, `foo\.bar`); string(res) != `{"baz\\":1}` {
+		t.Errorf("expected '%s', got '%s'", `{"baz\\":1}`, res)
+	}
+	if res := Get(json, `foo.bar`); string(res) != `2` {
+		t.Errorf("expected '%s', got '%s'", `2`, res)
+	}
+	exp := `{"foo.bar":{"baz\\":1},"foo":{"bar":2,"a.b":3}}`
+	if res := Set(json, `foo.a\.b`, 3); string(res) != exp {
+		t.Errorf("expected '%s', got '%s'", exp, res)
+	}
+}
+
+func TestQuotedPath(t *testing.T) {
+	json := []byte(`{"a.b":{"c":1},"a":{"b.c":2,"b":{"c":3}}}`)
+	tests := []struct {
+		path string
+		exp  string
+	}{
+		{`"a.b".c`, `1`},
+		{`a."b.c"`, `2`},
+		{`a.b.c`, `3`},
+		{`"a"."b"."c"`, `3`},
+		{`"a.b"."c"`, `1`},
+	}
+	for _, test := range tests {
+		if res := Get(json, test.path); string(res) != test.exp {
+			t.Errorf("Get(%q): expected '%s', got '%s'", test.path, test.exp, res)
+		}
+	}
+	exp := `{"a.b":{"c":1,"d.e":4},"a":{"b.c":2,"b":{"c":3}}}`
+	if res := Set(json, `"a.b"."d.e"`, 4); string(res) != exp {
+		t.Errorf("expected '%s', got '%s'", exp, res)
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	tests := []struct {
+		path    string
+		pointer string
+	}{
+		{``, ``},
+		{`foo`, `/foo`},
+		{`foo.0.bar`, `/foo/0/bar`},
+		{`a/b.c~d`, `/a~1b/c~0d`},
+		{`~01`, `/~001`},
+		{`foo\.bar.baz`, `/foo.bar/baz`},
+		{`foo\\bar`, `/foo\bar`},
+		{`\"foo".\"`, `/"foo"/"`},
+	}
+	for _, test := range tests {
+		if pointer := PathToPointer(test.path); pointer != test.pointer {
+			t.Errorf("PathToPointer(%q): expected %q, got %q", test.path, test.pointer, pointer)
+		}
+		if path, err := PointerToPath(test.pointer); err != nil {
+			t.Errorf("PointerToPath(%q): unexpected error: %v", test.pointer, err)
+		} else if path != test.path {
+			t.Errorf("PointerToPath(%q): expected %q, got %q", test.pointer, test.path, path)
+		}
+	}
+
+	for _, pointer := range []string{`foo`, `/`, `/a/`, `/a//b`, `//`, `/foo~`, `/foo~2`} {
+		if _, err := PointerToPath(pointer); err == nil {
+			t.Errorf("PointerToPath(%q): expected error", pointer)
 		}
 	}
 }
@@ -188,6 +3075,9 @@ func TestLocateAccessor(t *testing.T) {
 		{`{"foo":0 , "bar":7}`, `bar`, len(`{"foo":0 , "bar":`)},
 		{`{"foo":0,"bar":7}3`, `bar`, len(`{"foo":0,"bar":`)},
 		{`{"foo":0,"bar":7} 3`, `bar`, len(`{"foo":0,"bar":`)},
+		{`{"foo":0`, `bar`, -1},
+		{`{"foo":0,`, `bar`, -1},
+		{`{"foo"`, `foo`, -1},
 		// array
 		{`[1,2,3]`, `0`, 1},
 		{`[1,2,3]`, `1`, 3},
@@ -197,6 +3087,15 @@ func TestLocateAccessor(t *testing.T) {
 		{`[1,2,3]`, `foo`, -1},
 		{`[]`, `0`, 1},
 		{`[]`, `1`, -1},
+		{`[1,2,3]`, `-1`, 5},
+		{`[1,2,3]`, `-3`, 1},
+		{`[1,2,3]`, `-4`, -1},
+		{`[]`, `-1`, -1},
+		{`[1,2`, `-1`, -1},
+		{`[1,2,3]`, `-`, 6},
+		{`[ ]`, `-`, 2},
+		{`[1`, `-`, -1},
+		{`null`, `-`, 3},
 		// null
 		{`null`, `0`, 3}, // special case
 		{`null`, `1`, -1},
@@ -208,7 +3107,7 @@ func TestLocateAccessor(t *testing.T) {
 		{`3`, `3`, -1},
 	}
 	for _, test := range tests {
-		if loc := locateAccessor([]byte(test.json), test.acc); loc != test.loc {
+		if loc := locateAccessor([]byte(test.json), test.acc, nil); loc != test.loc {
 			t.Errorf("locateAccessor('%s', %q): expected %v, got %v", test.json, test.acc, test.loc, loc)
 		}
 	}
@@ -227,6 +3126,7 @@ func TestParseString(t *testing.T) {
 		{`"foo\"bar"`, `foo\"bar`, ``},
 		{`"foo\"bar":"baz"`, `foo\"bar`, `:"baz"`},
 		{`"foo\\\"bar":"baz"`, `foo\\\"bar`, `:"baz"`},
+		{`"foo\\":"baz"`, `foo\\`, `:"baz"`},
 	}
 	for _, test := range tests {
 		if str, rest := parseString([]byte(test.json)); string(str) != test.str || string(rest) != test.rest {
@@ -235,6 +3135,49 @@ func TestParseString(t *testing.T) {
 	}
 }
 
+func TestUnescapeString(t *testing.T) {
+	tests := []struct {
+		str string
+		exp string
+	}{
+		{``, ``},
+		{`foo`, `foo`},
+		{`foo\"bar`, `foo"bar`},
+		{`\\\/\b\f\n\r\t`, "\\/\b\f\n\r\t"},
+		{`café`, `café`},
+		{`\u00e9\u00C9`, `éÉ`},
+		{`\ud83d\ude00`, "\U0001F600"},
+		{`\ud83d`, "�"},
+		{`\ud83dx`, "�x"},
+		{`\u12`, `\u12`},
+		{`\x`, `\x`},
+		{`foo\`, `foo\`},
+	}
+	for _, test := range tests {
+		if str := unescapeString([]byte(test.str)); str != test.exp {
+			t.Errorf("unescapeString(%q): expected %q, got %q", test.str, test.exp, str)
+		}
+	}
+}
+
+func TestRemoveAccents(t *testing.T) {
+	tests := []struct {
+		str string
+		exp string
+	}{
+		{`foo`, `foo`},
+		{`café`, `cafe`},
+		{"café", `cafe`},
+		{`ÀÉÎÕÜÇÑÝàéîõüçñýÿ`, `AEIOUCNYaeioucnyy`},
+		{`Æßø`, `Æßo`},
+	}
+	for _, test := range tests {
+		if str := removeAccents(test.str); str != test.exp {
+			t.Errorf("removeAccents(%q): expected %q, got %q", test.str, test.exp, str)
+		}
+	}
+}
+
 func TestConsumeWhitespace(t *testing.T) {
 	tests := []struct {
 		json string
@@ -471,6 +3414,9 @@ func TestConsumeObject(t *testing.T) {
 		{`{"":{"":{"":{}}}}`, ``},
 		{`{"":{"":{"":{}}}}3`, `3`},
 		{`{"":{"":{"":{}}}} 3`, ` 3`},
+		{`{"}":"\\"}3`, `3`},
+		{`{"foo":0`, ``},
+		{`{"foo":"}`, ``},
 	}
 	for _, test := range tests {
 		if rest := consumeObject([]byte(test.json)); string(rest) != test.rest {
@@ -508,6 +3454,8 @@ func TestConsumeArray(t *testing.T) {
 		{`[["]", "]"], [{"foo":[]}]]`, ``},
 		{`[["]", "]"], [{"foo":[]}]]3`, `3`},
 		{`[["]", "]"], [{"foo":[]}]] 3`, ` 3`},
+		{`[0`, ``},
+		{`["]`, ``},
 	}
 	for _, test := range tests {
 		if rest := consumeArray([]byte(test.json)); string(rest) != test.rest {
@@ -528,6 +3476,7 @@ func TestConsumeString(t *testing.T) {
 		{`"foo\"bar"`, ``},
 		{`"foo\"bar":"baz"`, `:"baz"`},
 		{`"foo\\\"bar":"baz"`, `:"baz"`},
+		{`"foo\\":"baz"`, `:"baz"`},
 	}
 	for _, test := range tests {
 		if rest := consumeString([]byte(test.json)); string(rest) != test.rest {
@@ -579,6 +3528,156 @@ func TestConsumeNumber(t *testing.T) {
 	}
 }
 
+func TestAddLen(t *testing.T) {
+	tests := []struct {
+		a, b int
+		exp  int
+	}{
+		{0, 0, 0},
+		{3, 4, 7},
+		{maxInt - 1, 1, maxInt},
+		{maxInt, 0, maxInt},
+		{maxInt, 1, -1},
+		{1, maxInt, -1},
+		{maxInt / 2, maxInt/2 + 2, -1},
+		{-1, 3, -1},
+		{3, -1, -1},
+	}
+	for _, test := range tests {
+		if n := addLen(test.a, test.b); n != test.exp {
+			t.Errorf("addLen(%v, %v): expected %v, got %v", test.a, test.b, test.exp, n)
+		}
+	}
+}
+
+func TestReplacementLen(t *testing.T) {
+	tests := []struct {
+		c       byte
+		comma   bool
+		lastAcc string
+		val     string
+		exp     int
+	}{
+		{'"', false, `foo`, `3`, 1},
+		{']', true, `2`, `3`, 2},
+		{'}', true, `foo`, `3`, 8},
+		{'}', false, `foo`, `3`, 7},
+		{'l', false, `0`, `3`, 3},
+		{'}', false, "a\"b\n", `3`, 10},
+		{'}', false, "café", `3`, 9},
+	}
+	for _, test := range tests {
+		n := replacementLen(test.c, test.comma, test.lastAcc, []byte(test.val))
+		if n != test.exp {
+			t.Errorf("replacementLen(%q, %v, %q, '%s'): expected %v, got %v", test.c, test.comma, test.lastAcc, test.val, test.exp, n)
+		} else if b := appendReplacement(nil, test.c, test.comma, test.lastAcc, []byte(test.val)); len(b) != n {
+			t.Errorf("appendReplacement(%q, %v, %q, '%s'): expected %v bytes, got %v", test.c, test.comma, test.lastAcc, test.val, n, len(b))
+		}
+	}
+}
+
+func TestEscapeForString(t *testing.T) {
+	tests := []struct {
+		json string
+		exp  string
+	}{
+		{`{"a":1}`, `{\"a\":1}`},
+		{`{"a":"b\"c\\d"}`, `{\"a\":\"b\\\"c\\\\d\"}`},
+		{"[1,\n 2]", `[1,\n 2]`},
+		{`"<&>"`, `\"<&>\"`},
+		{``, ``},
+	}
+	for _, test := range tests {
+		res := EscapeForString([]byte(test.json))
+		if string(res) != test.exp {
+			t.Errorf("EscapeForString(%q): expected %q, got %q", test.json, test.exp, res)
+		}
+		quoted := `"` + string(res) + `"`
+		var s string
+		if err := Validate([]byte(quoted)); err != nil {
+			t.Errorf("EscapeForString(%q): quoted result is invalid: %v", test.json, err)
+		} else if err := gojson.Unmarshal([]byte(quoted), &s); err != nil || s != test.json {
+			t.Errorf("EscapeForString(%q): quoted result unescaped to %q (%v)", test.json, s, err)
+		}
+	}
+
+	json := Set([]byte(`{"a":1}`), "a", `{"b":"c"}`)
+	if !strings.Contains(string(json), string(EscapeForString([]byte(`{"b":"c"}`)))) {
+		t.Errorf("EscapeForString: Set escaped differently: %s", json)
+	}
+}
+
+func TestAppendEscapedString(t *testing.T) {
+	tests := []struct {
+		str string
+		exp string
+	}{
+		{"", `""`},
+		{"foo", `"foo"`},
+		{`foo"bar`, `"foo\"bar"`},
+		{`foo\bar`, `"foo\\bar"`},
+		{"\b\f\n\r\t", `"\b\f\n\r\t"`},
+		{"\x00\x01\x1f\x7f", `"\u0000\u0001\u001f` + "\x7f" + `"`},
+		{"<a&b>", `"<a&b>"`},
+		{"café 😀", `"café 😀"`},
+		{"\u2028\u2029", `"\u2028\u2029"`},
+		{"a\xffb", `"a\ufffdb"`},
+		{"\xe2\x82", `"\ufffd\ufffd"`},
+	}
+	for _, test := range tests {
+		if res := AppendEscapedString(nil, test.str); string(res) != test.exp {
+			t.Errorf("AppendEscapedString(%q): expected %s, got %s", test.str, test.exp, res)
+		}
+	}
+
+	// should append to dst
+	if res := AppendEscapedString([]byte("foo"), "bar"); string(res) != `foo"bar"` {
+		t.Errorf("AppendEscapedString: expected %s, got %s", `foo"bar"`, res)
+	}
+
+	// should decode to the original string
+	for _, test := range tests[:9] {
+		var s string
+		if err := gojson.Unmarshal(AppendEscapedString(nil, test.str), &s); err != nil {
+			t.Errorf("AppendEscapedString(%q): invalid JSON: %v", test.str, err)
+		} else if s != test.str {
+			t.Errorf("AppendEscapedString(%q): decoded to %q", test.str, s)
+		}
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	var all []byte
+	for c := byte(0); c < 0x20; c++ {
+		all = append(all, c)
+	}
+	for c := byte(0); c < 0x20; c++ {
+		for _, s := range []string{string(c), "a" + string(c) + "b", string(all)} {
+			for _, res := range [][]byte{
+				Set([]byte(`{}`), "a", s),
+				Set([]byte(`{"a":1}`), escapeAccessor(s), 2),
+				SetOpts(nil, escapeAccessor(s)+".0", 2, &Options{CreatePath: true}),
+			} {
+				if !gojson.Valid(res) || bytes.Contains(res, []byte(`\x`)) {
+					t.Fatalf("invalid JSON for %q: %q", s, res)
+				}
+			}
+		}
+	}
+
+	// escaped keys should be matched by their decoded value
+	json := Set([]byte(`{"x":0}`), "a\"b\n", 1)
+	if string(json) != `{"x":0,"a\"b\n":1}` {
+		t.Fatalf("expected escaped key, got '%s'", json)
+	}
+	if json = Set(json, "a\"b\n", 2); string(json) != `{"x":0,"a\"b\n":2}` {
+		t.Errorf("expected escaped key to be replaced, got '%s'", json)
+	}
+	if json = Set([]byte(`{"\u0061":1}`), "a", 2); string(json) != `{"\u0061":2}` {
+		t.Errorf("expected escaped key to be replaced, got '%s'", json)
+	}
+}
+
 func TestMarshal(t *testing.T) {
 	b := marshal(3)
 	if !bytes.Equal(b, []byte(`3`)) {
@@ -589,7 +3688,7 @@ func TestMarshal(t *testing.T) {
 			t.Fatal("expected panic")
 		}
 	}()
-	marshal(map[interface{}]interface{}{})
+	marshal(make(chan int))
 }
 
 func BenchmarkConsumeWhitespace(b *testing.B) {